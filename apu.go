@@ -1,6 +1,6 @@
 package main
 
-import "sync"
+import "sync/atomic"
 
 const (
 	addrNr10        = 0xff10
@@ -32,7 +32,9 @@ const (
 // This component is quite complicated with lots of quirks and edge cases, see:
 // https://gbdev.gg8.se/wiki/articles/Gameboy_sound_hardware
 type Apu struct {
-	divApu byte
+	cgb bool
+	// Next step of the frame sequencer (0-7), which clocks the length timers, the sweep and the envelopes.
+	frameStep byte
 
 	// Master volume & VIN panning
 	masterVolume byte
@@ -53,6 +55,9 @@ type Apu struct {
 	volume [4]byte
 	// Volume envelope, which increases or decreases the volume over time. Not used for channel 3.
 	volumeEnvelope [4]byte
+	// Envelope timer, and whether the envelope still changes the volume (it stops at 0 or 15).
+	envelopeTimer   [4]byte
+	envelopeRunning [4]bool
 	// Timer decrements every cycle. When it reaches 0, a new sample is produced.
 	frequencyTimer [4]uint16
 	// Current period of the channel (not used for channel 4), opposite of the frequency.
@@ -66,20 +71,44 @@ type Apu struct {
 	ch1SweepShadowPeriod uint16
 	ch1SweepEnabled      bool
 	ch1SweepTimer        byte
+	// Whether a period was calculated in negate mode since the channel was triggered.
+	ch1SweepNegated bool
 
 	// Channel 2
 	ch2DutyCycle byte
 
 	// Channel 3
 	ch3Wave [16]byte
+	// The byte of ch3Wave that is playing, read when the position changes, and the tick at which it was read.
+	ch3SampleBuffer byte
+	ch3ReadTick     int
 
 	// Channel 4
 	ch4Randomness byte
 	ch4Lfsr       uint16
 
-	// Buffer of audio samples we have generated. A new sample is produced every ~48kHz.
-	samples   []AudioSample
-	samplesMu sync.Mutex
+	// Buffer of audio samples we have generated, until they are played. A new sample is produced every ~48kHz.
+	output AudioRing
+	// Changes the rate of the samples added to output, to follow the speed of the player.
+	resampler Resampler
+	// Whether the samples are being played, in which case the rate of output follows the speed of the player.
+	playing atomic.Bool
+	// Last sample played, repeated when the buffer is empty.
+	lastOutput [2]float32
+	// Signaled every time samples are played, can be nil.
+	consumed chan struct{}
+	// Set when the emulator is paced by the audio output, so that the sample rate needs no adjustment.
+	fixedSampleRate bool
+	// Receives every sample, can be nil.
+	sampleListener SampleListener
+	// Receives every write to the registers, can be nil.
+	writeListener ApuWriteListener
+	// Debug settings, not visible to the game.
+	mutes ChannelMutes
+
+	// Band-limited output of each channel, and filters on the left and right outputs.
+	blips    [4]BlipBuffer
+	highPass [2]HighPassFilter
 
 	// Incremented every APU tick (2Mhz)
 	tick int
@@ -87,23 +116,26 @@ type Apu struct {
 
 type AudioSample struct {
 	left, right float32
+	// Output of each channel, between 0 and 1, before panning, master volume and high-pass filter.
+	channels [4]float32
 }
 
-func (a *Apu) OnTimer(divOld byte, divNew byte) {
-	if !(isBitSet(divOld, 4) && !isBitSet(divNew, 4)) {
+// ClockFrameSequencer runs the next step of the frame sequencer, called by the timer on a falling edge of the system
+// counter: the length timers are clocked at every even step, the sweep at steps 2 and 6, the envelopes at step 7.
+func (a *Apu) ClockFrameSequencer() {
+	if !a.audioEnabled {
 		return
 	}
-	a.divApu++
-
-	if a.divApu%4 == 0 {
+	if a.frameStep%2 == 0 {
+		a.handleLengthTimer()
+	}
+	if a.frameStep == 2 || a.frameStep == 6 {
 		a.handleSweep()
 	}
-	if a.divApu%8 == 0 {
+	if a.frameStep == 7 {
 		a.handleEnvelope()
 	}
-	if a.divApu%2 == 0 {
-		a.handleLengthTimer()
-	}
+	a.frameStep = (a.frameStep + 1) % 8
 }
 
 // handleSweep handles frequency sweeping (increase/decrease of frequency over time) for the first channel
@@ -143,6 +175,7 @@ func (a *Apu) calcNewSweepPeriod() uint16 {
 		newPeriod += delta
 	} else {
 		newPeriod -= delta
+		a.ch1SweepNegated = true
 	}
 	return newPeriod
 }
@@ -165,13 +198,20 @@ func (a *Apu) handleEnvelope() {
 			// Envelope disabled
 			continue
 		}
-		if a.divApu%(8*pace) == 0 {
-			increaseVolume := isBitSet(a.volumeEnvelope[c], 3)
-			if increaseVolume && a.volume[c] != 0xF {
-				a.volume[c]++
-			} else if !increaseVolume && a.volume[c] != 0 {
-				a.volume[c]--
-			}
+		if a.envelopeTimer[c] > 0 {
+			a.envelopeTimer[c]--
+		}
+		if a.envelopeTimer[c] > 0 || !a.envelopeRunning[c] {
+			continue
+		}
+		a.envelopeTimer[c] = pace
+		increaseVolume := isBitSet(a.volumeEnvelope[c], 3)
+		if increaseVolume && a.volume[c] != 0xF {
+			a.volume[c]++
+		} else if !increaseVolume && a.volume[c] != 0 {
+			a.volume[c]--
+		} else {
+			a.envelopeRunning[c] = false
 		}
 	}
 }
@@ -179,18 +219,31 @@ func (a *Apu) handleEnvelope() {
 // handleLengthTimer handles the length timer, which auto-disables a channel after a certain amount of time.
 func (a *Apu) handleLengthTimer() {
 	for c := 0; c < 4; c++ {
-		if a.timerEnabled[c] {
-			a.lengthTimer[c]--
-			if a.lengthTimer[c] == 0 {
-				// Turn off the channel
-				a.channelsOn[c] = false
-			}
+		a.clockLengthTimer(c)
+	}
+}
+
+// clockLengthTimer decrements the length timer of a channel, if enabled, and turns off the channel when it expires.
+func (a *Apu) clockLengthTimer(chNum int) {
+	if a.timerEnabled[chNum] && a.lengthTimer[chNum] > 0 {
+		a.lengthTimer[chNum]--
+		if a.lengthTimer[chNum] == 0 {
+			// Turn off the channel
+			a.channelsOn[chNum] = false
 		}
 	}
 }
 
 func (a *Apu) Get(addr uint16) (byte, bool) {
 	if addr >= addrWavePattern && addr < addrWavePattern+16 {
+		if a.channelsOn[2] {
+			// While playing, the wave RAM can only be accessed at the byte being played. On DMG, only at the moment it
+			// is read by the channel.
+			if !a.waveRamAccessible() {
+				return 0xff, true
+			}
+			return a.ch3Wave[a.wavePosition[2]/2], true
+		}
 		return a.ch3Wave[addr-addrWavePattern], true
 	}
 
@@ -260,205 +313,145 @@ func (a *Apu) Get(addr uint16) (byte, bool) {
 }
 
 func (a *Apu) Set(addr uint16, v byte) bool {
+	if a.writeListener != nil && addr >= addrNr10 && addr < addrWavePattern+16 {
+		a.writeListener.OnApuWrite(a.tick, addr, v)
+	}
+
 	if addr >= addrWavePattern && addr < addrWavePattern+16 {
+		if a.channelsOn[2] {
+			// Same as reads, only the byte being played can be written.
+			if a.waveRamAccessible() {
+				a.ch3Wave[a.wavePosition[2]/2] = v
+			}
+			return true
+		}
 		a.ch3Wave[addr-addrWavePattern] = v
 		return true
 	}
 
+	// When the APU is off, the registers can't be written, except NR52. On DMG, the length timers can still be set.
+	if !a.audioEnabled && addr != addrNr52 {
+		if !a.cgb {
+			switch addr {
+			case addrNr11:
+				a.lengthTimer[0] = 64 - uint16(v&0x3f)
+			case addrNr21:
+				a.lengthTimer[1] = 64 - uint16(v&0x3f)
+			case addrNr31:
+				a.lengthTimer[2] = 256 - uint16(v)
+			case addrNr41:
+				a.lengthTimer[3] = 64 - uint16(v&0x3f)
+			}
+		}
+		return addr >= addrNr10 && addr <= addrNr51
+	}
+
 	switch addr {
 	case addrNr10:
-		if a.audioEnabled {
-			if a.channelsOn[0] && a.ch1SweepEnabled && !isBitSet(v, 3) && isBitSet(a.ch1Sweep, 3) {
-				// Changing sweep direction pos->neg turns the channel off.
-				a.channelsOn[0] = false
-			}
-			a.ch1Sweep = v
+		if a.ch1SweepNegated && !isBitSet(v, 3) && isBitSet(a.ch1Sweep, 3) {
+			// Changing sweep direction neg->pos, after a period was calculated in negate mode, turns the channel off.
+			a.channelsOn[0] = false
 		}
+		a.ch1Sweep = v
 		return true
 	case addrNr11:
-		if a.audioEnabled {
-			a.lengthTimer[0] = 64 - uint16(v&0x3f)
-			a.ch1DutyCycle = v >> 6
-		}
+		a.lengthTimer[0] = 64 - uint16(v&0x3f)
+		a.ch1DutyCycle = v >> 6
 		return true
 	case addrNr12:
-		if a.audioEnabled {
-			a.volumeEnvelope[0] = v
-			if v&0xf8 == 0 {
-				a.channelsOn[0] = false
-				a.dacEnabled[0] = false
-			} else {
-				a.dacEnabled[0] = true
-			}
-		}
+		a.setVolumeEnvelope(0, v)
 		return true
 	case addrNr13:
-		if a.audioEnabled {
-			a.period[0] = (a.period[0] & 0x700) | uint16(v)
-		}
+		a.period[0] = (a.period[0] & 0x700) | uint16(v)
 		return true
 	case addrNr14:
-		if a.audioEnabled {
-			// Set period upper 3 bits
-			a.period[0] = (uint16(v&0x7) << 8) | (a.period[0] & 0xff)
+		// Set period upper 3 bits
+		a.period[0] = (uint16(v&0x7) << 8) | (a.period[0] & 0xff)
+		if a.setLengthEnable(0, v, 64) {
+			a.trigger(0)
+
+			// Sweep: the period is copied to the shadow register, and an overflow turns off the channel immediately.
+			hasSweepShift := (a.ch1Sweep & 0x7) != 0
+			hasSweepPace := (a.ch1Sweep & 0x70) != 0
 			a.ch1SweepShadowPeriod = a.period[0]
-			// Set timer enable
-			a.timerEnabled[0] = isBitSet(v, 6)
-			if a.timerEnabled[0] && a.lengthTimer[0] == 0 {
-				a.lengthTimer[0] = 64 // Timer 0 means max length
-			}
-			// Trigger channel
-			trigger := isBitSet(v, 7)
-			if a.dacEnabled[0] && trigger {
-				a.volume[0] = (a.volumeEnvelope[0] & 0xf0) >> 4
-				a.wavePosition[0] = 0
-				a.frequencyTimer[0] = maxPeriod + 1 - a.period[0]
-
-				hasSweepShift := (a.ch1Sweep & 0x7) != 0
-				hasSweepPace := (a.ch1Sweep & 0x70) != 0
-				a.updateSweepTimer()
-				a.ch1SweepEnabled = hasSweepShift || hasSweepPace
-
-				a.channelsOn[0] = true
-				if hasSweepShift && a.calcNewSweepPeriod() > maxPeriod {
-					a.channelsOn[0] = false
-				}
+			a.ch1SweepNegated = false
+			a.updateSweepTimer()
+			a.ch1SweepEnabled = hasSweepShift || hasSweepPace
+			if hasSweepShift && a.calcNewSweepPeriod() > maxPeriod {
+				a.channelsOn[0] = false
 			}
 		}
 		return true
 	case addrNr21:
-		if a.audioEnabled {
-			a.lengthTimer[1] = 64 - uint16(v&0x3f)
-			a.ch2DutyCycle = v >> 6
-		}
+		a.lengthTimer[1] = 64 - uint16(v&0x3f)
+		a.ch2DutyCycle = v >> 6
 		return true
 	case addrNr22:
-		if a.audioEnabled {
-			a.volumeEnvelope[1] = v
-			if v&0xf8 == 0 {
-				a.channelsOn[1] = false
-				a.dacEnabled[1] = false
-			} else {
-				a.dacEnabled[1] = true
-			}
-		}
+		a.setVolumeEnvelope(1, v)
 		return true
 	case addrNr23:
-		if a.audioEnabled {
-			a.period[1] = (a.period[1] & 0x700) | uint16(v)
-		}
+		a.period[1] = (a.period[1] & 0x700) | uint16(v)
 		return true
 	case addrNr24:
-		if a.audioEnabled {
-			// Set period upper 3 bits
-			a.period[1] = (uint16(v&0x7) << 8) | (a.period[1] & 0xff)
-			// Set timer enable
-			a.timerEnabled[1] = isBitSet(v, 6)
-			if a.timerEnabled[1] && a.lengthTimer[1] == 0 {
-				a.lengthTimer[1] = 64 // Timer 0 means max length
-			}
-			// Trigger channel
-			trigger := isBitSet(v, 7)
-			if a.dacEnabled[1] && trigger {
-				a.volume[1] = (a.volumeEnvelope[1] & 0xf0) >> 4
-				a.wavePosition[1] = 0
-				a.frequencyTimer[1] = maxPeriod + 1 - a.period[1]
-				a.channelsOn[1] = true
-			}
+		// Set period upper 3 bits
+		a.period[1] = (uint16(v&0x7) << 8) | (a.period[1] & 0xff)
+		if a.setLengthEnable(1, v, 64) {
+			a.trigger(1)
 		}
 		return true
 	case addrNr30:
-		if a.audioEnabled {
-			// Set channel 3 DAC
-			a.dacEnabled[2] = isBitSet(v, 7)
-			if !a.dacEnabled[2] {
-				a.channelsOn[2] = false
-			}
+		// Set channel 3 DAC
+		a.dacEnabled[2] = isBitSet(v, 7)
+		if !a.dacEnabled[2] {
+			a.channelsOn[2] = false
 		}
 		return true
 	case addrNr31:
-		if a.audioEnabled {
-			a.lengthTimer[2] = 256 - uint16(v)
-		}
+		a.lengthTimer[2] = 256 - uint16(v)
 		return true
 	case addrNr32:
-		if a.audioEnabled {
-			a.volume[2] = v >> 5
-		}
+		a.volume[2] = (v >> 5) & 0x3
 		return true
 	case addrNr33:
-		if a.audioEnabled {
-			a.period[2] = (a.period[2] & 0x700) | uint16(v)
-		}
+		a.period[2] = (a.period[2] & 0x700) | uint16(v)
 		return true
 	case addrNr34:
-		if a.audioEnabled {
-			// Set period upper 3 bits
-			a.period[2] = (uint16(v&0x7) << 8) | (a.period[2] & 0xff)
-			// Set timer enable
-			a.timerEnabled[2] = isBitSet(v, 6)
-			if a.timerEnabled[2] && a.lengthTimer[2] == 0 {
-				a.lengthTimer[2] = 256 // Timer 0 means max length
-			}
-			// Trigger channel 3
-			trigger := isBitSet(v, 7)
-			if a.dacEnabled[2] && trigger {
-				a.wavePosition[2] = 0
-				a.frequencyTimer[2] = maxPeriod + 1 - a.period[2]
-				a.channelsOn[2] = true
+		// Set period upper 3 bits
+		a.period[2] = (uint16(v&0x7) << 8) | (a.period[2] & 0xff)
+		if a.setLengthEnable(2, v, 256) {
+			// The channel reads the wave RAM in the next APU tick, which is in the same cycle as the write since the
+			// CPU ticks before the APU in Emulator.Tick.
+			if !a.cgb && a.channelsOn[2] && a.frequencyTimer[2] == 1 {
+				a.corruptWaveRam()
 			}
+			a.trigger(2)
 		}
 		return true
 	case addrNr41:
-		if a.audioEnabled {
-			a.lengthTimer[3] = 64 - uint16(v&0x3f)
-		}
+		a.lengthTimer[3] = 64 - uint16(v&0x3f)
 		return true
 	case addrNr42:
-		if a.audioEnabled {
-			a.volumeEnvelope[3] = v
-			if v&0xf8 == 0 {
-				a.dacEnabled[3] = false
-				a.channelsOn[3] = false
-			} else {
-				a.dacEnabled[3] = true
-			}
-		}
+		a.setVolumeEnvelope(3, v)
 		return true
 	case addrNr43:
-		if a.audioEnabled {
-			a.ch4Randomness = v
-		}
+		a.ch4Randomness = v
 		return true
 	case addrNr44:
-		if a.audioEnabled {
-			// Set timer enable
-			a.timerEnabled[3] = isBitSet(v, 6)
-			// Trigger channel
-			if a.timerEnabled[3] && a.lengthTimer[3] == 0 {
-				a.lengthTimer[3] = 64 // Timer 0 means max length
-			}
-			trigger := isBitSet(v, 7)
-			if a.dacEnabled[3] && trigger {
-				a.ch4Lfsr = 0x7fff
-				a.volume[3] = (a.volumeEnvelope[3] & 0xf0) >> 4
-				a.channelsOn[3] = true
-			}
+		if a.setLengthEnable(3, v, 64) {
+			a.trigger(3)
 		}
 		return true
 	case addrNr50:
-		if a.audioEnabled {
-			a.masterVolume = v
-		}
+		a.masterVolume = v
 		return true
 	case addrNr51:
-		if a.audioEnabled {
-			a.panning = v
-		}
+		a.panning = v
 		return true
 	case addrNr52:
-		a.audioEnabled = isBitSet(v, 7)
-		if !a.audioEnabled {
+		enabled := isBitSet(v, 7)
+		if enabled && !a.audioEnabled {
+			a.powerOn()
+		} else if !enabled && a.audioEnabled {
 			a.powerOff()
 		}
 		return true
@@ -466,15 +459,108 @@ func (a *Apu) Set(addr uint16, v byte) bool {
 	return false
 }
 
+// setLengthEnable handles the length enable bit of a NRx4 write, and returns whether the channel is triggered.
+// Quirk: when the next step of the frame sequencer doesn't clock the length timer, enabling the timer clocks it once
+// more, and a trigger that reloads the timer to its maximum value clocks it as well.
+func (a *Apu) setLengthEnable(chNum int, v byte, maxLength uint16) bool {
+	wasEnabled := a.timerEnabled[chNum]
+	a.timerEnabled[chNum] = isBitSet(v, 6)
+	trigger := isBitSet(v, 7)
+	extraClock := a.frameStep%2 == 1
+
+	if extraClock && !wasEnabled && a.timerEnabled[chNum] && a.lengthTimer[chNum] > 0 {
+		a.lengthTimer[chNum]--
+		if a.lengthTimer[chNum] == 0 && !trigger {
+			a.channelsOn[chNum] = false
+		}
+	}
+	if trigger && a.lengthTimer[chNum] == 0 {
+		a.lengthTimer[chNum] = maxLength // Timer 0 means max length
+		if extraClock && a.timerEnabled[chNum] {
+			a.lengthTimer[chNum]--
+		}
+	}
+	return trigger
+}
+
+// trigger restarts a channel. The channel is turned on only if its DAC is enabled, the rest happens in any case.
+func (a *Apu) trigger(chNum int) {
+	a.channelsOn[chNum] = a.dacEnabled[chNum]
+	switch chNum {
+	case 2:
+		// The first sample is read after a short delay, the sample buffer is not reloaded until then.
+		a.wavePosition[2] = 0
+		a.frequencyTimer[2] = maxPeriod + 1 - a.period[2] + 3
+	case 3:
+		a.ch4Lfsr = 0x7fff
+		a.frequencyTimer[3] = a.noisePeriod()
+	default:
+		a.frequencyTimer[chNum] = maxPeriod + 1 - a.period[chNum]
+	}
+	if chNum != 2 {
+		a.volume[chNum] = (a.volumeEnvelope[chNum] & 0xf0) >> 4
+		// Like the sweep timer, a pace of 0 is treated as 8.
+		a.envelopeTimer[chNum] = a.volumeEnvelope[chNum] & 0x7
+		if a.envelopeTimer[chNum] == 0 {
+			a.envelopeTimer[chNum] = 8
+		}
+		a.envelopeRunning[chNum] = true
+	}
+}
+
+// setVolumeEnvelope writes NRx2. Quirk ("zombie mode"): writing it while the channel is on changes the volume, in a
+// way that depends on the old and new values.
+func (a *Apu) setVolumeEnvelope(chNum int, v byte) {
+	old := a.volumeEnvelope[chNum]
+	a.volumeEnvelope[chNum] = v
+	if a.channelsOn[chNum] {
+		volume := a.volume[chNum]
+		if old&0x7 == 0 && a.envelopeRunning[chNum] {
+			volume++
+		} else if !isBitSet(old, 3) {
+			volume += 2
+		}
+		if (old^v)&0x8 != 0 {
+			volume = 16 - volume
+		}
+		a.volume[chNum] = volume & 0xf
+	}
+
+	a.dacEnabled[chNum] = v&0xf8 != 0
+	if !a.dacEnabled[chNum] {
+		a.channelsOn[chNum] = false
+	}
+}
+
+// waveRamAccessible returns whether the CPU can access the wave RAM while channel 3 is playing: on DMG, only in the
+// same cycle the channel reads it. This relies on the CPU ticking before the APU in Emulator.Tick: a read in the 2 APU
+// ticks of an emulator tick is seen by the CPU in the next one, when the difference is 0 or 1.
+func (a *Apu) waveRamAccessible() bool {
+	return a.cgb || a.tick-a.ch3ReadTick < 2
+}
+
+// corruptWaveRam emulates a DMG bug: triggering channel 3 while it reads the wave RAM corrupts its first bytes, with
+// the byte being read (if in the first 4 bytes) or with the 4 bytes around it.
+func (a *Apu) corruptWaveRam() {
+	pos := (a.wavePosition[2] + 1) % 32 / 2
+	if pos < 4 {
+		a.ch3Wave[0] = a.ch3Wave[pos]
+	} else {
+		copy(a.ch3Wave[:4], a.ch3Wave[pos&^3:pos&^3+4])
+	}
+}
+
+// powerOff clears all the registers. On DMG, the length timers are not affected.
 func (a *Apu) powerOff() {
 	a.audioEnabled = false
 	a.masterVolume = 0
 	a.panning = 0
 	a.channelsOn = [4]bool{false, false, false, false}
 	a.dacEnabled = [4]bool{false, false, false, false}
-	a.lengthTimer = [4]uint16{0, 0, 0, 0}
+	if a.cgb {
+		a.lengthTimer = [4]uint16{0, 0, 0, 0}
+	}
 	a.timerEnabled = [4]bool{false, false, false, false}
-	a.wavePosition = [3]int{0, 0, 0}
 	a.volume = [4]byte{0, 0, 0, 0}
 	a.volumeEnvelope = [4]byte{0, 0, 0, 0}
 	a.period = [3]uint16{0, 0, 0}
@@ -483,12 +569,19 @@ func (a *Apu) powerOff() {
 	a.ch1SweepShadowPeriod = 0
 	a.ch1Sweep = 0
 	a.ch1SweepTimer = 0
+	a.ch1SweepNegated = false
 	a.ch1DutyCycle = 0
 
 	a.ch2DutyCycle = 0
 
 	a.ch4Randomness = 0
 	a.ch4Lfsr = 0
+}
 
-	a.samples = a.samples[:0]
+// powerOn resets the frame sequencer, so that its next step is 0, and the position of the waves.
+func (a *Apu) powerOn() {
+	a.audioEnabled = true
+	a.frameStep = 0
+	a.wavePosition = [3]int{0, 0, 0}
+	a.ch3SampleBuffer = 0
 }
@@ -11,41 +11,85 @@ var pulseWaves = [][]byte{
 	{0, 1, 1, 1, 1, 1, 1, 0},
 }
 
-const maxSamples = 1000
-const samplesPerRead = 10
-const ticksPerSample = clockFreq * 2 / audioSampleRate // *2 because APU runs at 2Mhz
+const apuSampleRate = audioSampleRate
+
+const (
+	// Number of samples the output buffer should have, about 40ms of audio.
+	audioTargetFill = audioRingSize / 4
+	// Maximum change of the sample rate to keep the output buffer at audioTargetFill, small enough to not be audible.
+	maxRateAdjustment = 0.005
+	// When the output buffer is empty, the last sample is repeated for this many samples, instead of a gap.
+	underrunSamples = 64
+)
 
 // Read fills the buffer with 32 bit stereo PCM audio samples
 func (a *Apu) Read(buf []byte) (int, error) {
-	a.samplesMu.Lock()
-	if len(a.samples) == 0 {
-		a.samplesMu.Unlock()
-		return 0, nil
+	if !a.playing.Swap(true) {
+		// Samples produced before playing started would only add latency.
+		for a.output.Len() > audioTargetFill {
+			a.output.Pop()
+		}
 	}
-	numSamples := min(len(buf), len(a.samples), samplesPerRead)
-	for i := 0; i < numSamples; i++ {
-		addSampleToBuf(buf, i, a.samples[i])
+
+	numSamples := a.readSamples(buf)
+
+	// Wake up the emulator, if it is waiting for space in the buffer. This is done after the samples are removed, so
+	// that it sees the space and doesn't wait for the next read.
+	select {
+	case a.consumed <- struct{}{}:
+	default:
 	}
-	a.samples = a.samples[numSamples:]
-	a.samplesMu.Unlock()
 	return 8 * numSamples, nil
 }
 
+// readSamples moves samples from the output buffer to buf, it returns the number of samples written.
+func (a *Apu) readSamples(buf []byte) int {
+	numSamples := len(buf) / 8
+	for i := 0; i < numSamples; i++ {
+		left, right, ok := a.output.Pop()
+		if !ok {
+			if i == 0 {
+				// Holding the last value avoids a click, and the rate control should refill the buffer.
+				numSamples = min(numSamples, underrunSamples)
+				for ; i < numSamples; i++ {
+					addSampleToBuf(buf, i, a.lastOutput[0], a.lastOutput[1])
+				}
+			}
+			return i
+		}
+		a.lastOutput = [2]float32{left, right}
+		addSampleToBuf(buf, i, left, right)
+	}
+	return numSamples
+}
+
 // Tick advances the APU one step, which should be called at 2Mhz.
 // This generates new audio samples and moves the position of the current wave in each channel.
 func (a *Apu) Tick() {
 	a.tick += 1
 
-	// Produce an audio sample
-	if a.tick%ticksPerSample == 0 {
-		sample := a.genSample()
-		a.samplesMu.Lock()
-		if len(a.samples) > maxSamples {
-			// TODO: This is a very crude way to do this...use a better method
-			a.samples = a.samples[:0]
+	// The output of each channel goes through a blip buffer, which produces band-limited samples.
+	for chNum := range a.blips {
+		a.blips[chNum].Tick(a.channelOutput(chNum))
+	}
+	if s, ok := a.blips[0].ReadSample(); ok {
+		// All the buffers advance together, so they have a sample at the same time.
+		sample := AudioSample{}
+		sample.channels[0] = s
+		for chNum := 1; chNum < len(a.blips); chNum++ {
+			sample.channels[chNum], _ = a.blips[chNum].ReadSample()
+		}
+		a.mixSample(&sample)
+
+		// Only the samples played go through the rate control, the listeners get the samples at apuSampleRate.
+		if a.playing.Load() && !a.fixedSampleRate {
+			a.adjustSampleRate()
+		}
+		// If the buffer is full, nobody is playing the samples, or the rate control could not keep up.
+		a.resampler.Resample(sample.left, sample.right, &a.output)
+		if a.sampleListener != nil {
+			a.sampleListener.OnSample(sample)
 		}
-		a.samples = append(a.samples, sample)
-		a.samplesMu.Unlock()
 	}
 
 	// Update the state of each channel
@@ -58,29 +102,32 @@ func (a *Apu) Tick() {
 	}
 }
 
+// adjustSampleRate changes the rate of the samples played slightly, so that the output buffer stays around
+// audioTargetFill: the emulator and the audio device have different clocks, without this the buffer would slowly empty
+// or overflow. A fuller buffer results in fewer samples per emulated second.
+func (a *Apu) adjustSampleRate() {
+	fill := float64(a.output.Len()-audioTargetFill) / audioTargetFill
+	fill = max(-1, min(fill, 1))
+	a.resampler.SetRatio(1 - maxRateAdjustment*fill)
+}
+
 func (a *Apu) tickChannel(chNum int, waveLen int) {
 	a.frequencyTimer[chNum]--
 	if a.frequencyTimer[chNum] == 0 {
 		a.frequencyTimer[chNum] = maxPeriod + 1 - a.period[chNum]
 		a.wavePosition[chNum] = (a.wavePosition[chNum] + 1) % waveLen
+		if chNum == 2 {
+			a.ch3SampleBuffer = a.ch3Wave[a.wavePosition[2]/2]
+			a.ch3ReadTick = a.tick
+		}
 	}
 }
 
 func (a *Apu) tickNoiseChannel() {
 	a.frequencyTimer[3]--
 	if a.frequencyTimer[3] == 0 {
-		// Note: since we do this at 1Mhz, the divider will be 1/4 of the divisor code map shown in various websites.
-		// For example, divisor code 6 will be 24, not 96.
-		divisorCode := int(a.ch4Randomness & 0x7)
-		shift := (a.ch4Randomness & 0xf0) >> 4
+		a.frequencyTimer[3] = a.noisePeriod()
 		shortMode := isBitSet(a.ch4Randomness, 3)
-		if divisorCode == 0 {
-			a.frequencyTimer[3] = 2
-		} else {
-			a.frequencyTimer[3] = uint16(divisorCode << 2)
-		}
-		a.frequencyTimer[3] <<= shift
-
 		xorBit := (a.ch4Lfsr & 1) ^ ((a.ch4Lfsr & 2) >> 1)
 		a.ch4Lfsr = a.ch4Lfsr>>1 | xorBit<<14
 		if shortMode {
@@ -90,14 +137,28 @@ func (a *Apu) tickNoiseChannel() {
 	}
 }
 
-func (a *Apu) genSample() AudioSample {
-	var sample AudioSample
-
-	if !a.audioEnabled {
-		return sample
+// noisePeriod returns the number of ticks between two shifts of the LFSR of channel 4.
+func (a *Apu) noisePeriod() uint16 {
+	// Note: since we do this at 1Mhz, the divider will be 1/4 of the divisor code map shown in various websites.
+	// For example, divisor code 6 will be 24, not 96.
+	divisorCode := int(a.ch4Randomness & 0x7)
+	shift := (a.ch4Randomness & 0xf0) >> 4
+	period := uint16(2)
+	if divisorCode != 0 {
+		period = uint16(divisorCode << 2)
 	}
-	for i := 0; i < 4; i++ {
-		a.mixChannelOnSample(&sample, i)
+	return period << shift
+}
+
+// mixSample mixes the output of the channels to the left and right outputs.
+func (a *Apu) mixSample(sample *AudioSample) {
+	for chNum, s := range sample.channels {
+		if isBitSet(a.panning, 4+chNum) {
+			sample.left += s
+		}
+		if isBitSet(a.panning, chNum) {
+			sample.right += s
+		}
 	}
 
 	leftVolume := float32((a.masterVolume&0x70)>>4+1) / 8
@@ -106,12 +167,16 @@ func (a *Apu) genSample() AudioSample {
 	// Normalize the volume by diving by 4, since we are adding up 4 channels.
 	sample.left = sample.left / 4 * leftVolume
 	sample.right = sample.right / 4 * rightVolume
-	return sample
+
+	dacsEnabled := a.audioEnabled && (a.dacEnabled[0] || a.dacEnabled[1] || a.dacEnabled[2] || a.dacEnabled[3])
+	sample.left = a.highPass[0].Filter(sample.left, dacsEnabled)
+	sample.right = a.highPass[1].Filter(sample.right, dacsEnabled)
 }
 
-func (a *Apu) mixChannelOnSample(sample *AudioSample, chNum int) {
-	if !a.channelsOn[chNum] || a.volume[chNum] == 0 {
-		return
+// channelOutput returns the current output of a channel, between 0 and 1.
+func (a *Apu) channelOutput(chNum int) float32 {
+	if !a.audioEnabled || !a.channelsOn[chNum] || a.volume[chNum] == 0 || !a.mutes.isAudible(chNum) {
+		return 0
 	}
 
 	var s float32
@@ -125,19 +190,12 @@ func (a *Apu) mixChannelOnSample(sample *AudioSample, chNum int) {
 	case 3:
 		s = float32(^a.ch4Lfsr&1) * float32(a.volume[3])
 	}
-
-	s /= 0xf // Normalize sample between 0 and 1
-	if isBitSet(a.panning, 4+chNum) {
-		sample.left += s
-	}
-	if isBitSet(a.panning, chNum) {
-		sample.right += s
-	}
+	return s / 0xf // Normalize sample between 0 and 1
 }
 
 func (a *Apu) getWaveSample() byte {
 	// Two 4-bit samples are stored in each byte, so pick the byte first and then the nibble
-	waveSample := a.ch3Wave[a.wavePosition[2]/2]
+	waveSample := a.ch3SampleBuffer
 	if a.wavePosition[2]%2 == 0 {
 		waveSample = (waveSample & 0xf0) >> 4
 	} else {
@@ -153,15 +211,15 @@ func (a *Apu) getWaveSample() byte {
 	return waveSample
 }
 
-func addSampleToBuf(buf []byte, pos int, audioSample AudioSample) {
+func addSampleToBuf(buf []byte, pos int, left float32, right float32) {
 	// 4 bytes per channel as a float 32
-	leftBits := math.Float32bits(audioSample.left)
+	leftBits := math.Float32bits(left)
 	buf[8*pos] = byte(leftBits)
 	buf[8*pos+1] = byte(leftBits >> 8)
 	buf[8*pos+2] = byte(leftBits >> 16)
 	buf[8*pos+3] = byte(leftBits >> 24)
 
-	rightBits := math.Float32bits(audioSample.right)
+	rightBits := math.Float32bits(right)
 	buf[8*pos+4] = byte(rightBits)
 	buf[8*pos+5] = byte(rightBits >> 8)
 	buf[8*pos+6] = byte(rightBits >> 16)
@@ -0,0 +1,235 @@
+package main
+
+import "testing"
+
+func TestLengthExtraClock(t *testing.T) {
+	tests := []struct {
+		name       string
+		frameStep  byte
+		wasEnabled bool
+		length     uint16
+		nr24       byte
+		wantLength uint16
+		wantOn     bool
+	}{
+		{"enable, next step clocks length", 0, false, 10, 0x40, 10, true},
+		{"enable, next step doesn't clock length", 1, false, 10, 0x40, 9, true},
+		{"already enabled", 1, true, 10, 0x40, 10, true},
+		{"disable", 1, true, 10, 0x00, 10, true},
+		{"extra clock to 0 turns the channel off", 1, false, 1, 0x40, 0, false},
+		{"extra clock to 0 with trigger reloads", 1, false, 1, 0xc0, 63, true},
+		{"trigger with length 0, next step clocks length", 0, false, 0, 0xc0, 64, true},
+		{"trigger with length 0, next step doesn't clock length", 1, false, 0, 0xc0, 63, true},
+		{"trigger with length 0, length disabled", 1, false, 0, 0x80, 64, true},
+		{"trigger with length 0, length already enabled", 1, true, 0, 0xc0, 63, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Apu{audioEnabled: true, frameStep: tt.frameStep}
+			a.channelsOn[1], a.dacEnabled[1] = true, true
+			a.timerEnabled[1] = tt.wasEnabled
+			a.lengthTimer[1] = tt.length
+			a.Set(addrNr24, tt.nr24)
+			if a.lengthTimer[1] != tt.wantLength || a.channelsOn[1] != tt.wantOn {
+				t.Errorf("Length %d and channel on %v, want %d and %v", a.lengthTimer[1], a.channelsOn[1],
+					tt.wantLength, tt.wantOn)
+			}
+		})
+	}
+}
+
+func TestZombieMode(t *testing.T) {
+	tests := []struct {
+		name             string
+		oldNr22, newNr22 byte
+		volume           byte
+		envelopeRunning  bool
+		wantVolume       byte
+	}{
+		{"pace 0, envelope running", 0xf0, 0xf0, 5, true, 6},
+		{"pace 0, envelope stopped, decreasing", 0xf0, 0xf0, 5, false, 7},
+		{"decreasing", 0xf1, 0xf1, 5, true, 7},
+		{"increasing", 0xf9, 0xf9, 5, true, 5},
+		{"pace 0, envelope stopped, increasing", 0xf8, 0xf8, 5, false, 5},
+		{"increasing to decreasing", 0xf9, 0xf1, 5, true, 11},
+		{"decreasing to increasing", 0xf1, 0xf9, 5, true, 9},
+		{"wraps around", 0xf0, 0xf0, 15, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Apu{audioEnabled: true}
+			a.channelsOn[1], a.dacEnabled[1] = true, true
+			a.volumeEnvelope[1] = tt.oldNr22
+			a.volume[1] = tt.volume
+			a.envelopeRunning[1] = tt.envelopeRunning
+			a.Set(addrNr22, tt.newNr22)
+			if a.volume[1] != tt.wantVolume {
+				t.Errorf("Volume %d, want %d", a.volume[1], tt.wantVolume)
+			}
+		})
+	}
+
+	a := &Apu{audioEnabled: true}
+	a.volumeEnvelope[1], a.volume[1] = 0xf0, 5
+	a.Set(addrNr22, 0xf8)
+	if a.volume[1] != 5 {
+		t.Errorf("Volume %d after a write with the channel off, want 5", a.volume[1])
+	}
+}
+
+func TestSweepNegateLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		nr10       byte
+		clockSweep bool
+		newNr10    byte
+		wantOn     bool
+	}{
+		{"negate calculated on trigger, then increase", 0x19, false, 0x11, false},
+		{"negate calculated by the sweep, then increase", 0x18, true, 0x10, false},
+		{"negate calculated, still negate", 0x19, false, 0x1a, true},
+		{"negate not calculated, shift 0", 0x18, false, 0x10, true},
+		{"increase, then negate", 0x11, false, 0x19, true},
+		{"increase, negate never calculated", 0x11, false, 0x11, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Apu{audioEnabled: true}
+			a.Set(addrNr12, 0xf0)
+			a.Set(addrNr10, tt.nr10)
+			a.Set(addrNr13, 0x00)
+			a.Set(addrNr14, 0x84) // Trigger, period 0x400
+			if !a.channelsOn[0] {
+				t.Fatal("The channel is off after the trigger")
+			}
+			if tt.clockSweep {
+				a.handleSweep()
+			}
+			a.Set(addrNr10, tt.newNr10)
+			if a.channelsOn[0] != tt.wantOn {
+				t.Errorf("Channel on %v, want %v", a.channelsOn[0], tt.wantOn)
+			}
+		})
+	}
+}
+
+func TestWaveRamAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		cgb     bool
+		playing bool
+		// APU ticks since channel 3 read the wave RAM.
+		sinceRead int
+		wantRead  byte
+		// Index of the byte changed by a write, -1 if none.
+		wantWritten int
+	}{
+		{"stopped", false, false, 10, 0xaa, 10},
+		{"DMG, read in this cycle", false, true, 0, 0x33, 3},
+		{"DMG, read in the previous APU tick", false, true, 1, 0x33, 3},
+		{"DMG, read in a previous cycle", false, true, 2, 0xff, -1},
+		{"CGB, read in a previous cycle", true, true, 10, 0x33, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Apu{cgb: tt.cgb, audioEnabled: true, tick: 100}
+			for i := range a.ch3Wave {
+				a.ch3Wave[i] = byte(i * 0x11)
+			}
+			a.channelsOn[2] = tt.playing
+			a.wavePosition[2] = 6 // Byte 3 is being played
+			a.ch3ReadTick = a.tick - tt.sinceRead
+
+			// The CPU reads and writes byte 10, while the channel plays byte 3.
+			if got, _ := a.Get(addrWavePattern + 10); got != tt.wantRead {
+				t.Errorf("Read 0x%02x, want 0x%02x", got, tt.wantRead)
+			}
+			before := a.ch3Wave
+			a.Set(addrWavePattern+10, 0x5a)
+			for i := range a.ch3Wave {
+				want := before[i]
+				if i == tt.wantWritten {
+					want = 0x5a
+				}
+				if a.ch3Wave[i] != want {
+					t.Errorf("Wave RAM byte %d is 0x%02x after the write, want 0x%02x", i, a.ch3Wave[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestWaveRamCorruption(t *testing.T) {
+	tests := []struct {
+		name           string
+		cgb            bool
+		playing        bool
+		frequencyTimer uint16
+		wavePosition   int
+		want           [4]byte
+	}{
+		{"next byte in the first 4", false, true, 1, 3, [4]byte{2, 1, 2, 3}},
+		{"next byte after the first 4", false, true, 1, 9, [4]byte{4, 5, 6, 7}},
+		{"next byte in the last 4", false, true, 1, 29, [4]byte{12, 13, 14, 15}},
+		{"not reading", false, true, 2, 9, [4]byte{0, 1, 2, 3}},
+		{"stopped", false, false, 1, 9, [4]byte{0, 1, 2, 3}},
+		{"CGB", true, true, 1, 9, [4]byte{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Apu{cgb: tt.cgb, audioEnabled: true}
+			for i := range a.ch3Wave {
+				a.ch3Wave[i] = byte(i)
+			}
+			a.dacEnabled[2], a.channelsOn[2] = true, tt.playing
+			a.frequencyTimer[2] = tt.frequencyTimer
+			a.wavePosition[2] = tt.wavePosition
+			a.Set(addrNr34, 0x80) // Retrigger
+			if got := [4]byte(a.ch3Wave[:4]); got != tt.want {
+				t.Errorf("The first bytes of the wave RAM are %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLengthWhilePoweredOff(t *testing.T) {
+	tests := []struct {
+		name       string
+		cgb        bool
+		addr       uint16
+		value      byte
+		chNum      int
+		wantLength uint16
+	}{
+		{"DMG NR11", false, addrNr11, 0xff, 0, 1},
+		{"DMG NR21", false, addrNr21, 0x01, 1, 63},
+		{"DMG NR31", false, addrNr31, 0x10, 2, 240},
+		{"DMG NR41", false, addrNr41, 0x3e, 3, 2},
+		{"CGB NR21", true, addrNr21, 0x01, 1, 10},
+		{"DMG NR22", false, addrNr22, 0x01, 1, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Apu{cgb: tt.cgb}
+			a.lengthTimer[tt.chNum] = 10
+			a.Set(tt.addr, tt.value)
+			if a.lengthTimer[tt.chNum] != tt.wantLength {
+				t.Errorf("Length %d, want %d", a.lengthTimer[tt.chNum], tt.wantLength)
+			}
+			// Only the length can be written, not the duty cycle or the envelope.
+			if a.ch1DutyCycle != 0 || a.volumeEnvelope != [4]byte{} {
+				t.Errorf("Duty cycle %d and envelopes %v, want 0", a.ch1DutyCycle, a.volumeEnvelope)
+			}
+		})
+	}
+
+	// Powering off clears the lengths on CGB only.
+	for _, cgb := range []bool{false, true} {
+		a := &Apu{cgb: cgb, audioEnabled: true}
+		a.lengthTimer[0] = 10
+		a.Set(addrNr52, 0x00)
+		if want := map[bool]uint16{false: 10, true: 0}[cgb]; a.lengthTimer[0] != want {
+			t.Errorf("CGB %v: length %d after power off, want %d", cgb, a.lengthTimer[0], want)
+		}
+	}
+}
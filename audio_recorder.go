@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AudioRecorder records the audio produced by the APU to a stereo WAV file and, optionally, each channel to a separate
+// mono WAV file (a stem), named after the main file: out.wav, out_ch1.wav, ..., out_ch4.wav.
+type AudioRecorder struct {
+	mix   *WavWriter
+	stems []*WavWriter
+	// The channels' outputs are between 0 and 1: like the mix, the stems go through a high-pass filter, which centers
+	// them around 0.
+	highPass [4]HighPassFilter
+}
+
+// StartAudioRecording creates the WAV file at the given path and, if stems is true, the 4 stems.
+func StartAudioRecording(path string, stems bool) (*AudioRecorder, error) {
+	mix, err := CreateWavWriter(path, apuSampleRate, 2)
+	if err != nil {
+		return nil, err
+	}
+	r := &AudioRecorder{mix: mix}
+	if !stems {
+		return r, nil
+	}
+
+	for i := 1; i <= 4; i++ {
+		stem, err := CreateWavWriter(fmt.Sprintf("%s_ch%d.wav", strings.TrimSuffix(path, ".wav"), i), apuSampleRate, 1)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.stems = append(r.stems, stem)
+	}
+	return r, nil
+}
+
+// AddSample adds an audio sample to the mix and to the stems.
+func (r *AudioRecorder) AddSample(sample AudioSample) error {
+	if err := r.mix.WriteSample(sample.left, sample.right); err != nil {
+		return err
+	}
+	for i, stem := range r.stems {
+		if err := stem.WriteSample(r.highPass[i].Filter(sample.channels[i], true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes writing the files.
+func (r *AudioRecorder) Close() error {
+	err := r.mix.Close()
+	for _, stem := range r.stems {
+		if closeErr := stem.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioRecorderCentersStems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	recorder, err := StartAudioRecording(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Channel 1 is on at full volume for one second, the other channels are silent.
+	for i := 0; i < apuSampleRate; i++ {
+		if err := recorder.AddSample(AudioSample{channels: [4]float32{1, 0, 0, 0}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), "out_ch1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := int16(binary.LittleEndian.Uint16(data[wavHeaderSize:]))
+	last := int16(binary.LittleEndian.Uint16(data[len(data)-2:]))
+	if first < 32000 {
+		t.Errorf("The first sample of the stem is %d, want the full volume", first)
+	}
+	if last < -100 || last > 100 {
+		t.Errorf("The last sample of the stem is %d, want the DC offset to be removed", last)
+	}
+}
+
+func TestWavWriterWrongNumberOfChannels(t *testing.T) {
+	wav, err := CreateWavWriter(filepath.Join(t.TempDir(), "out.wav"), apuSampleRate, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wav.Close()
+	if err := wav.WriteSample(0); err == nil {
+		t.Error("Writing a mono sample to a stereo file succeeded, want an error")
+	}
+}
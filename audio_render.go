@@ -0,0 +1,47 @@
+package main
+
+// audioRenderer discards the pixels, and writes the audio samples to a WAV file.
+type audioRenderer struct {
+	headlessDisplay
+	wav *WavWriter
+	err error
+}
+
+func (r *audioRenderer) OnSample(sample AudioSample) {
+	if r.err == nil {
+		r.err = r.wav.WriteSample(sample.left, sample.right)
+	}
+}
+
+// RenderAudio runs the game, as fast as possible and without display, for the given number of frames, pressing the
+// keys of the input events, and saves the audio to a WAV file. The output only depends on the inputs, so it can be
+// compared across runs: the RTC follows the emulated time. The scanline renderer is used, which is faster but has a
+// different mode 3 timing than the default one. If gbs is not nil, rom must be its Rom, and its first song is played.
+func RenderAudio(bootRom []byte, rom []byte, gbs *GbsFile, frames int, events []InputEvent, path string) error {
+	wav, err := CreateWavWriter(path, apuSampleRate, 2)
+	if err != nil {
+		return err
+	}
+	renderer := &audioRenderer{wav: wav}
+	emulator := MakeEmulator(bootRom, rom, EmulatorOptions{fastPpu: true, emulatedRtc: true}, renderer)
+	emulator.SetSampleListener(renderer)
+	if gbs != nil {
+		MakeGbsPlayer(gbs, &emulator)
+	}
+
+	for frame := 0; frame < frames && renderer.err == nil; frame++ {
+		for len(events) > 0 && events[0].frame <= frame {
+			emulator.joypad.SetPressedKeys(events[0].keys)
+			events = events[1:]
+		}
+		for i := 0; i < ticksPerFrame; i++ {
+			emulator.Tick()
+		}
+	}
+
+	err = wav.Close()
+	if renderer.err != nil {
+		return renderer.err
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeTestRom returns a 32KB ROM of the given cartridge type, which runs the code from 0x150.
+func makeTestRom(cartridgeType byte, code ...byte) []byte {
+	rom := make([]byte, 0x8000)
+	writeOpcodes(rom, 0x100, 0x00, 0xc3, 0x50, 0x01) // NOP, JP 0x150
+	rom[0x147] = cartridgeType
+	writeOpcodes(rom, 0x150, code...)
+	return rom
+}
+
+// rtcTestRom plays a note on channel 2 whose period depends on the seconds of the RTC.
+var rtcTestRom = makeTestRom(0x0f, // MBC3+TIMER+BATTERY
+	0x3e, 0x80, 0xe0, 0x26, // NR52 = 0x80
+	0x3e, 0xff, 0xe0, 0x25, // NR51 = 0xff
+	0x3e, 0x77, 0xe0, 0x24, // NR50 = 0x77
+	0x3e, 0x80, 0xe0, 0x16, // NR21 = 0x80
+	0x3e, 0xf0, 0xe0, 0x17, // NR22 = 0xf0
+	0x3e, 0x86, 0xe0, 0x19, // NR24 = 0x86, trigger
+	0x3e, 0x08, 0xea, 0x00, 0x40, // Select the RTC seconds
+	// Loop: the low bits of the period are the seconds.
+	0xfa, 0x00, 0xa0, // LD A, (0xa000)
+	0x87, 0x87, 0x87, // ADD A, A (x3)
+	0xe0, 0x18, // LDH (NR23), A
+	0x18, 0xf6, // JR loop
+)
+
+func TestRenderAudioIsDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	var hashes [2][sha256.Size]byte
+	for i := range hashes {
+		path := filepath.Join(dir, "out.wav")
+		// Long enough for the RTC seconds to change.
+		if err := RenderAudio(nil, rtcTestRom, nil, 90, nil, path); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// At least a second of 16 bit stereo samples, 1.5 are rendered.
+		if minSize := wavHeaderSize + apuSampleRate*4; len(data) < minSize {
+			t.Fatalf("The WAV file has %d bytes, want at least %d", len(data), minSize)
+		}
+		hashes[i] = sha256.Sum256(data)
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("The two renders differ: %x and %x", hashes[0], hashes[1])
+	}
+}
+
+func TestEmulatedRtc(t *testing.T) {
+	emulator := MakeEmulator(nil, rtcTestRom, EmulatorOptions{emulatedRtc: true}, headlessDisplay{})
+	cartridge := emulator.mcu.cartridge
+	// 1 hour, 2 minutes and 3.5 seconds.
+	emulator.apu.tick = (3600+2*60+3)*clockFreq*2 + clockFreq
+	for register, want := range map[int]byte{0x08: 3, 0x09: 2, 0x0a: 1} {
+		cartridge.mbc3RtcRegister = register
+		if got := cartridge.readMbc3Rtc(); got != want {
+			t.Errorf("RTC register 0x%02x = %d, want %d", register, got, want)
+		}
+	}
+}
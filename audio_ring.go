@@ -0,0 +1,41 @@
+package main
+
+import "sync/atomic"
+
+const audioRingSize = 8192 // Must be a power of 2.
+
+// AudioRing is a lock-free ring buffer of stereo samples, with a single producer (the emulator) and a single consumer
+// (the audio player). Each side only writes its own index, so no lock is needed.
+type AudioRing struct {
+	samples [audioRingSize][2]float32
+	// Total number of samples written and read. The difference is the number of samples in the buffer.
+	written atomic.Uint64
+	read    atomic.Uint64
+}
+
+// Push adds a sample to the buffer, it returns false if the buffer is full and the sample was dropped.
+func (r *AudioRing) Push(left float32, right float32) bool {
+	written := r.written.Load()
+	if written-r.read.Load() == audioRingSize {
+		return false
+	}
+	r.samples[written%audioRingSize] = [2]float32{left, right}
+	r.written.Store(written + 1)
+	return true
+}
+
+// Pop removes the oldest sample from the buffer, it returns false if the buffer is empty.
+func (r *AudioRing) Pop() (float32, float32, bool) {
+	read := r.read.Load()
+	if r.written.Load() == read {
+		return 0, 0, false
+	}
+	s := r.samples[read%audioRingSize]
+	r.read.Store(read + 1)
+	return s[0], s[1], true
+}
+
+// Len returns the number of samples in the buffer.
+func (r *AudioRing) Len() int {
+	return int(r.written.Load() - r.read.Load())
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// The clock of the signals added to the buffer (the APU clock) and the rate of the output samples.
+	blipClockRate  = clockFreq * 2
+	blipSampleRate = apuSampleRate
+	// The position of a clock in the output is in fixed point, with this many bits for the fraction of a sample.
+	blipFractionBits = 32
+	// How much the position advances at each clock.
+	blipStep = blipSampleRate << blipFractionBits / blipClockRate
+	// Each amplitude change is spread over blipWidth output samples, with a kernel chosen among blipPhases depending
+	// on when the change happens between two samples.
+	blipWidth      = 16
+	blipPhaseBits  = 6
+	blipPhases     = 1 << blipPhaseBits
+	blipBufferSize = 64 // Must be a power of 2, larger than blipWidth.
+	// The kernel cuts frequencies above this fraction of the sample rate. Slightly less than the Nyquist frequency
+	// (0.5), to leave room for the transition band of the filter.
+	blipCutoff = 0.45
+)
+
+var blipKernel = makeBlipKernel()
+
+// BlipBuffer converts a signal made of steps (e.g. a square wave), sampled at blipClockRate, to band-limited samples
+// at blipSampleRate. Point-sampling such a signal would alias: frequencies above the Nyquist frequency would fold back
+// as audible noise. Instead, every amplitude change is added as a band-limited step: the deltas are spread over a few
+// samples with a windowed sinc kernel, and the output is the sum of all the deltas so far.
+// Based on the idea of blargg's blip_buf. The zero value is an empty buffer.
+type BlipBuffer struct {
+	// Position of the current clock in the output (fixed point).
+	time      uint64
+	amplitude float32
+	// Ring buffer of deltas, indexed by sample number.
+	deltas     [blipBufferSize]float32
+	nextSample uint64
+	sum        float32
+}
+
+// Tick advances the buffer by one clock, the signal has the given amplitude from this clock on.
+func (b *BlipBuffer) Tick(amplitude float32) {
+	if amplitude != b.amplitude {
+		b.addDelta(amplitude - b.amplitude)
+		b.amplitude = amplitude
+	}
+	b.time += blipStep
+}
+
+// ReadSample returns the next sample, if it is complete: there is a latency of blipWidth/2 samples, since a change
+// also affects the samples before it.
+func (b *BlipBuffer) ReadSample() (float32, bool) {
+	sample, _ := b.samplePosition()
+	if b.nextSample+blipWidth/2 > sample {
+		return 0, false
+	}
+	i := b.nextSample % blipBufferSize
+	b.sum += b.deltas[i]
+	b.deltas[i] = 0
+	b.nextSample++
+	return b.sum, true
+}
+
+func (b *BlipBuffer) addDelta(delta float32) {
+	sample, phase := b.samplePosition()
+	kernel := &blipKernel[phase]
+	first := sample - blipWidth/2 + 1
+	for i, v := range kernel {
+		b.deltas[(first+uint64(i))%blipBufferSize] += delta * v
+	}
+}
+
+// samplePosition returns the sample of the current clock and the position of the clock within that sample (the phase).
+// Samples are offset by blipWidth, so that the first deltas are not spread before sample 0.
+func (b *BlipBuffer) samplePosition() (uint64, int) {
+	sample := b.time>>blipFractionBits + blipWidth
+	phase := int(b.time & (1<<blipFractionBits - 1) >> (blipFractionBits - blipPhaseBits))
+	return sample, phase
+}
+
+// makeBlipKernel returns, for each phase, the impulse response of a low-pass filter (a sinc with a Blackman window)
+// centered at that phase.
+func makeBlipKernel() [blipPhases][blipWidth]float32 {
+	var kernel [blipPhases][blipWidth]float32
+	for phase := range kernel {
+		var taps [blipWidth]float64
+		var sum float64
+		for i := range taps {
+			// Distance between the sample and the step, in samples.
+			x := float64(i-blipWidth/2+1) - float64(phase)/blipPhases
+			window := 0.42 + 0.5*math.Cos(2*math.Pi*x/blipWidth) + 0.08*math.Cos(4*math.Pi*x/blipWidth)
+			taps[i] = sinc(2*blipCutoff*x) * window
+			sum += taps[i]
+		}
+		// Normalize so that a step of 1 results in an output of 1.
+		for i := range taps {
+			kernel[phase][i] = float32(taps[i] / sum)
+		}
+	}
+	return kernel
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// The DMG output goes through a capacitor that removes the DC offset: a high-pass filter. The charge factor is
+// 0.999958 per 4Mhz clock, see https://gbdev.io/pandocs/Audio_details.html#obscure-behavior.
+var highPassCharge = float32(math.Pow(0.999958, float64(clockFreq*4)/blipSampleRate))
+
+// HighPassFilter emulates the capacitor on each audio output.
+type HighPassFilter struct {
+	capacitor float32
+}
+
+// Filter returns the output for the given input sample. When all the DACs are off, the output is silent.
+func (f *HighPassFilter) Filter(in float32, dacsEnabled bool) float32 {
+	if !dacsEnabled {
+		return 0
+	}
+	out := in - f.capacitor
+	f.capacitor = in - out*highPassCharge
+	return out
+}
+
+// Resampler changes the rate of stereo samples by a ratio close to 1, with a linear interpolation. The zero value
+// keeps the rate unchanged.
+type Resampler struct {
+	// Input samples consumed per output sample, 0 means 1.
+	step float64
+	// Position of the next output sample after the previous input sample, in input samples.
+	position float64
+	previous [2]float32
+}
+
+// SetRatio sets the number of output samples per input sample.
+func (r *Resampler) SetRatio(ratio float64) {
+	r.step = 1 / ratio
+}
+
+// Resample adds an input sample, and pushes to the ring each output sample it completes (zero, one or two). If the
+// ring is full, the samples are dropped.
+func (r *Resampler) Resample(left float32, right float32, ring *AudioRing) {
+	step := r.step
+	if step == 0 {
+		step = 1
+	}
+	for r.position < 1 {
+		t := float32(r.position)
+		ring.Push(r.previous[0]+(left-r.previous[0])*t, r.previous[1]+(right-r.previous[1])*t)
+		r.position += step
+	}
+	r.position--
+	r.previous = [2]float32{left, right}
+}
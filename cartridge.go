@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
+const (
+	addrTitle    = 0x134
+	addrCgbFlag  = 0x143
+	maxTitleSize = 16
+)
+
 type Cartridge struct {
 	// What the program can access now
 	rom0           []byte
@@ -30,6 +38,30 @@ type Cartridge struct {
 	mbc3ReadRtc bool
 	// For MBC3, which RTC register to read/write
 	mbc3RtcRegister int
+	// For MBC3, returns the time of the RTC. The system clock if nil.
+	mbc3Clock func() time.Time
+}
+
+// IsCgbRom returns whether the cartridge supports the Game Boy Color features, according to its header.
+func IsCgbRom(rom []byte) bool {
+	return len(rom) > addrCgbFlag && isBitSet(rom[addrCgbFlag], 7)
+}
+
+// RomTitle returns the title of the game, according to its header.
+func RomTitle(rom []byte) string {
+	if len(rom) < addrTitle+maxTitleSize {
+		return ""
+	}
+	// In CGB games, the last byte of the title is the CGB flag. Newer games also use the last 4 characters for the
+	// manufacturer code, but there is no reliable way to tell.
+	title := rom[addrTitle : addrTitle+maxTitleSize]
+	if IsCgbRom(rom) {
+		title = title[:maxTitleSize-1]
+	}
+	if end := bytes.IndexByte(title, 0); end >= 0 {
+		title = title[:end]
+	}
+	return strings.TrimSpace(string(title))
 }
 
 func (c *Cartridge) Load(cartridge []byte) {
@@ -144,13 +176,17 @@ func (c *Cartridge) writeMbc1(address uint16, value byte) {
 }
 
 func (c *Cartridge) readMbc3Rtc() byte {
+	now := time.Now
+	if c.mbc3Clock != nil {
+		now = c.mbc3Clock
+	}
 	switch c.mbc3RtcRegister {
 	case 0x08:
-		return byte(time.Now().Second())
+		return byte(now().Second())
 	case 0x09:
-		return byte(time.Now().Minute())
+		return byte(now().Minute())
 	case 0x0a:
-		return byte(time.Now().Hour())
+		return byte(now().Hour())
 	case 0x0b:
 	case 0x0c:
 		// TODO: Support day counter.
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ChannelMutes are debug settings to listen to some of the APU channels only: channels can be muted, or soloed (when
+// any channel is soloed, only the soloed channels are played). They only change what is played, the registers seen by
+// the game (e.g. the channel-on flags in NR52) are not affected. Channels are numbered 0-3. They are toggled by the UI,
+// and read by the emulator goroutine.
+type ChannelMutes struct {
+	muted  [4]atomic.Bool
+	soloed [4]atomic.Bool
+}
+
+// ToggleMute mutes or unmutes the channel, returns true if the channel is now muted.
+func (m *ChannelMutes) ToggleMute(chNum int) bool {
+	return toggle(&m.muted[chNum])
+}
+
+// ToggleSolo solos or unsolos the channel, returns true if the channel is now soloed.
+func (m *ChannelMutes) ToggleSolo(chNum int) bool {
+	return toggle(&m.soloed[chNum])
+}
+
+// isAudible returns whether the channel should be mixed in the output.
+func (m *ChannelMutes) isAudible(chNum int) bool {
+	if m.muted[chNum].Load() {
+		return false
+	}
+	anySoloed := m.soloed[0].Load() || m.soloed[1].Load() || m.soloed[2].Load() || m.soloed[3].Load()
+	return !anySoloed || m.soloed[chNum].Load()
+}
+
+func (m *ChannelMutes) String() string {
+	var parts []string
+	for chNum := range m.muted {
+		state := "on"
+		if !m.isAudible(chNum) {
+			state = "off"
+		}
+		if m.muted[chNum].Load() {
+			state += " (muted)"
+		}
+		if m.soloed[chNum].Load() {
+			state += " (solo)"
+		}
+		parts = append(parts, fmt.Sprintf("ch%d: %s", chNum+1, state))
+	}
+	return strings.Join(parts, ", ")
+}
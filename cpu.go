@@ -4,6 +4,8 @@ type Cpu struct {
 	// Reference to memory controller and interrupt helper
 	mcu    *Mcu
 	interr *Interrupts
+	speed  *SpeedSwitch
+	timer  *Timer
 	// Immutable operations (micro-instructions) to execute for each opcode (and CB opcode)
 	regOps [][]func()
 	cbOps  [][]func()
@@ -27,8 +29,8 @@ type Cpu struct {
 	trace bool
 }
 
-func CreateCpu(mcu *Mcu, interrupts *Interrupts, trace bool) *Cpu {
-	cpu := Cpu{mcu: mcu, interr: interrupts, sp: 0xfffe, trace: trace}
+func CreateCpu(mcu *Mcu, interrupts *Interrupts, speed *SpeedSwitch, timer *Timer, trace bool) *Cpu {
+	cpu := Cpu{mcu: mcu, interr: interrupts, speed: speed, timer: timer, sp: 0xfffe, trace: trace}
 	cpu.regOps = cpu.makeRegOps()
 	cpu.cbOps = cpu.makeCbOps()
 	return &cpu
@@ -490,8 +492,13 @@ func call(cpu *Cpu, addr uint16) []func() {
 func nop() {}
 
 func (cpu *Cpu) stop() {
+	// STOP resets DIV, before the speed changes: the falling edges are those of the current speed.
+	cpu.timer.ResetDiv()
+	if cpu.speed.OnStop() {
+		// On CGB, STOP is used to switch speed.
+		return
+	}
 	cpu.paused = true
-	// TODO: should reset timer
 }
 
 func (cpu *Cpu) halt() {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// DebugView is what the window shows: the game, one of the VRAM viewers or the oscilloscope.
+type DebugView int
+
+const (
+	ViewGame DebugView = iota
+	ViewTiles
+	ViewTileMaps
+	ViewSprites
+	ViewAudio
+	numDebugViews
+)
+
+var debugViewNames = []string{"game", "tiles", "tile maps", "sprites", "audio"}
+
+func (v DebugView) String() string {
+	return debugViewNames[v]
+}
+
+const (
+	// The sprites view is drawn on a panel of fixed size, so that the text can be laid out next to the sprites.
+	spritesPanelWidth  = 720
+	spritesPanelHeight = 344
+	spritesPanelMargin = 8
+	spritesScale       = 3
+	spritesInfoColumn  = 232
+	debugTextHeight    = 16
+	// The audio view has the same size, with the information of each channel next to its waveform.
+	audioInfoX = spritesPanelMargin*2 + scopeWidth
+)
+
+var (
+	debugBackgroundColor = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+	// Transparent pixels of the sprites.
+	debugTransparentColor = color.RGBA{R: 0x40, G: 0x40, B: 0x60, A: 0xff}
+)
+
+// drawDebugView draws one of the VRAM viewers, or the oscilloscope, to the screen. It is updated at every frame.
+func (g *Game) drawDebugView(screen *ebiten.Image) {
+	palette := g.Palette()
+	var panel *ebiten.Image
+	switch g.debugView {
+	case ViewTiles:
+		panel = g.debugPanel(g.vramViewer.TilesImage(palette))
+	case ViewTileMaps:
+		panel = g.debugPanel(g.tileMapsImage(palette))
+	case ViewSprites:
+		panel = g.spritesPanel(palette)
+	case ViewAudio:
+		panel = g.audioPanel()
+	}
+
+	// Keep the aspect ratio, but do not apply the LCD filters.
+	screen.Fill(debugBackgroundColor)
+	screenSize, panelSize := screen.Bounds().Size(), panel.Bounds().Size()
+	x, y, width, _ := scaledRect(ScaleFit, screenSize.X, screenSize.Y, panelSize.X, panelSize.Y)
+	op := &ebiten.DrawImageOptions{}
+	scale := float64(width) / float64(panelSize.X)
+	op.GeoM.Scale(scale, scale)
+	op.GeoM.Translate(float64(x), float64(y))
+	screen.DrawImage(panel, op)
+}
+
+// tileMapsImage returns the two tile maps, side by side.
+func (g *Game) tileMapsImage(palette *DmgPalette) *image.RGBA {
+	map0 := g.vramViewer.TileMapImage(0, palette, true)
+	map1 := g.vramViewer.TileMapImage(1, palette, true)
+	size := map0.Bounds().Size()
+	img := image.NewRGBA(image.Rect(0, 0, size.X*2+viewerCellSpace, size.Y))
+	draw.Draw(img, map0.Bounds(), map0, image.Point{}, draw.Src)
+	draw.Draw(img, map1.Bounds().Add(image.Pt(size.X+viewerCellSpace, 0)), map1, image.Point{}, draw.Src)
+	return img
+}
+
+// spritesPanel returns the sprites, with their attributes on the right.
+func (g *Game) spritesPanel(palette *DmgPalette) *ebiten.Image {
+	if g.spritesPanelImage == nil {
+		g.spritesPanelImage = ebiten.NewImage(spritesPanelWidth, spritesPanelHeight)
+	}
+	panel := g.spritesPanelImage
+	panel.Fill(debugBackgroundColor)
+
+	sprites := g.debugPanel(g.vramViewer.SpritesImage(palette, debugTransparentColor))
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Scale(spritesScale, spritesScale)
+	op.GeoM.Translate(spritesPanelMargin, spritesPanelMargin)
+	panel.DrawImage(sprites, op)
+
+	infoX := spritesPanelMargin*2 + (spritesPerRow*(8+viewerCellSpace)-viewerCellSpace)*spritesScale
+	linesPerColumn := numSprites / 2
+	for i, line := range g.vramViewer.SpritesInfo() {
+		x := infoX + i/linesPerColumn*spritesInfoColumn
+		y := spritesPanelMargin + i%linesPerColumn*debugTextHeight
+		ebitenutil.DebugPrintAt(panel, line, x, y)
+	}
+	return panel
+}
+
+// audioPanel returns the waveforms of the 4 channels, with what they are playing on the right.
+func (g *Game) audioPanel() *ebiten.Image {
+	if g.audioPanelImage == nil {
+		g.audioPanelImage = ebiten.NewImage(spritesPanelWidth, spritesPanelHeight)
+	}
+	panel := g.audioPanelImage
+	panel.Fill(debugBackgroundColor)
+
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Translate(spritesPanelMargin, spritesPanelMargin)
+	panel.DrawImage(g.debugPanel(g.oscilloscope.WaveformsImage()), op)
+
+	for chNum, lines := range g.oscilloscope.ChannelsInfo() {
+		for i, line := range lines {
+			y := spritesPanelMargin + chNum*(scopeHeight+viewerCellSpace) + i*debugTextHeight
+			ebitenutil.DebugPrintAt(panel, line, audioInfoX, y)
+		}
+	}
+	return panel
+}
+
+// debugPanel copies the image to an ebiten image, which is reused as long as the size does not change.
+func (g *Game) debugPanel(img *image.RGBA) *ebiten.Image {
+	size := img.Bounds().Size()
+	if g.debugImage == nil || g.debugImage.Bounds().Size() != size {
+		if g.debugImage != nil {
+			g.debugImage.Deallocate()
+		}
+		g.debugImage = ebiten.NewImage(size.X, size.Y)
+	}
+	g.debugImage.WritePixels(img.Pix)
+	return g.debugImage
+}
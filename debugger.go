@@ -10,7 +10,12 @@ import (
 )
 
 type Debugger struct {
-	cpu         *Cpu
+	cpu        *Cpu
+	layers     *Layers
+	vramViewer *VramViewer
+	mutes      *ChannelMutes
+	// Returns the palette of the VRAM dumps, the first one if nil.
+	palette     func() *DmgPalette
 	breakpoints []uint16
 	paused      bool
 }
@@ -43,7 +48,7 @@ func (dbg *Debugger) prompt() {
 			panic(err)
 		}
 		args := strings.Fields(cmd)
-		if len(args) != 1 {
+		if len(args) == 0 {
 			println("Unknown command, try 'help'")
 			return
 		}
@@ -95,6 +100,48 @@ func (dbg *Debugger) prompt() {
 			} else {
 				println("Usage: x <addr|$reg>")
 			}
+		case "l", "layer":
+			if len(args) == 2 {
+				if args[1] == "tint" {
+					dbg.layers.ToggleTint()
+				} else if layer, err := ParseLayer(args[1]); err == nil {
+					dbg.layers.Toggle(layer)
+				} else {
+					println("Unknown layer, try bg, window, obj or tint")
+					continue
+				}
+			}
+			fmt.Println(dbg.layers)
+		case "mute", "solo":
+			if len(args) == 2 {
+				chNum, err := strconv.Atoi(args[1])
+				if err != nil || chNum < 1 || chNum > 4 {
+					println("Invalid channel, try 1-4")
+					continue
+				}
+				if args[0] == "mute" {
+					dbg.mutes.ToggleMute(chNum - 1)
+				} else {
+					dbg.mutes.ToggleSolo(chNum - 1)
+				}
+			}
+			fmt.Println(dbg.mutes)
+		case "d", "dump":
+			dir := "."
+			if len(args) == 2 {
+				dir = args[1]
+			}
+			palette := &dmgPalettes[0]
+			if dbg.palette != nil {
+				palette = dbg.palette()
+			}
+			paths, err := DumpVram(dbg.vramViewer, palette, dir)
+			for _, path := range paths {
+				fmt.Println("Saved", path)
+			}
+			if err != nil {
+				fmt.Println("Failed to dump VRAM:", err)
+			}
 		case "q", "quit":
 			os.Exit(0)
 		case "h", "help":
@@ -103,6 +150,10 @@ func (dbg *Debugger) prompt() {
 			println("b or break <addr> - sets a breakpoint at the given address")
 			println("i b or info b - prints all the breakpoints")
 			println("x <addr|$reg> - prints the memory at the given address (e.g. 0xff) or register (e.g. $HL)")
+			println("l or layer [bg|window|obj|tint] - hides/shows a layer or tints pixels by layer, prints the layers")
+			println("mute [1-4] - mutes/unmutes an audio channel, prints the channels")
+			println("solo [1-4] - solos/unsolos an audio channel, prints the channels")
+			println("d or dump [dir] - saves the tiles, tile maps and sprites as PNG files in dir (default: current dir)")
 			println("q or quit - quit")
 		default:
 			println("Unknown command, try 'help'")
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hajimehoshi/ebiten/v2"
+	"math"
+)
+
+// ScaleMode defines how the emulator output is scaled to the window.
+type ScaleMode int
+
+const (
+	// ScaleInteger scales by the largest integer factor that fits, so that all the pixels have the same size.
+	ScaleInteger ScaleMode = iota
+	// ScaleFit scales as much as possible while keeping the aspect ratio.
+	ScaleFit
+	// ScaleStretch fills the whole window.
+	ScaleStretch
+)
+
+var scaleModeNames = []string{"integer", "fit", "stretch"}
+
+func (m ScaleMode) String() string {
+	return scaleModeNames[m]
+}
+
+// ParseScaleMode returns the scale mode with the given name.
+func ParseScaleMode(name string) (ScaleMode, error) {
+	for i, modeName := range scaleModeNames {
+		if modeName == name {
+			return ScaleMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scale mode %q", name)
+}
+
+// DisplayOptions are the post-processing filters applied to the emulator output.
+type DisplayOptions struct {
+	// Blend each frame with the previous ones, like the slow response of the DMG LCD.
+	ghosting bool
+	// Darken the border of each pixel, like the dot matrix of the LCD.
+	grid bool
+	// Mix the colors like the CGB LCD, which is less saturated than a modern screen.
+	colorCorrection bool
+	scaleMode       ScaleMode
+}
+
+const (
+	// How much of the previous frame is kept when ghosting is enabled.
+	ghostingPersistence = 0.5
+	// How much the pixel borders are darkened when the grid is enabled.
+	gridIntensity = 0.35
+	// The grid is not drawn if the pixels are smaller than this, it would just darken the whole image.
+	gridMinScale = 3
+)
+
+// ghostingShader mixes the current frame (image 0) with the previous output (image 1).
+var ghostingShader = []byte(`//kage:unit pixels
+package main
+
+var Persistence float
+
+func Fragment(dstPos vec4, srcPos vec2, color vec4) vec4 {
+	return mix(imageSrc0At(srcPos), imageSrc1At(srcPos), Persistence)
+}
+`)
+
+// lcdShader draws the grid and corrects the colors of an image which has already been scaled to the window, where
+// each emulator pixel is Scale window pixels large.
+var lcdShader = []byte(`//kage:unit pixels
+package main
+
+var Scale vec2
+var GridIntensity float
+var ColorCorrection float
+
+func Fragment(dstPos vec4, srcPos vec2, color vec4) vec4 {
+	c := imageSrc0At(srcPos)
+	rgb := c.rgb
+	if ColorCorrection > 0 {
+		rgb = vec3(26*rgb.r+4*rgb.g+2*rgb.b, 24*rgb.g+8*rgb.b, 6*rgb.r+4*rgb.g+22*rgb.b) / 32
+	}
+	if GridIntensity > 0 {
+		cell := mod(srcPos-imageSrc0Origin(), Scale)
+		if cell.x < 1 || cell.y < 1 {
+			rgb *= 1 - GridIntensity
+		}
+	}
+	return vec4(rgb, c.a)
+}
+`)
+
+// Display draws the emulator output to the window, applying the post-processing filters.
+type Display struct {
+	options       DisplayOptions
+	ghostingShd   *ebiten.Shader
+	lcdShd        *ebiten.Shader
+	ghostingImage *ebiten.Image // The previous output, when ghosting is enabled
+	blendedImage  *ebiten.Image
+	scaledImage   *ebiten.Image
+}
+
+func MakeDisplay(options DisplayOptions) (*Display, error) {
+	ghostingShd, err := ebiten.NewShader(ghostingShader)
+	if err != nil {
+		return nil, fmt.Errorf("ghosting shader: %v", err)
+	}
+	lcdShd, err := ebiten.NewShader(lcdShader)
+	if err != nil {
+		return nil, fmt.Errorf("LCD shader: %v", err)
+	}
+	return &Display{options: options, ghostingShd: ghostingShd, lcdShd: lcdShd}, nil
+}
+
+func (d *Display) ToggleGhosting() {
+	d.options.ghosting = !d.options.ghosting
+	// Do not blend with an old frame when ghosting is enabled again.
+	d.ghostingImage = nil
+}
+
+func (d *Display) ToggleGrid() {
+	d.options.grid = !d.options.grid
+}
+
+func (d *Display) ToggleColorCorrection() {
+	d.options.colorCorrection = !d.options.colorCorrection
+}
+
+func (d *Display) NextScaleMode() ScaleMode {
+	d.options.scaleMode = (d.options.scaleMode + 1) % ScaleMode(len(scaleModeNames))
+	return d.options.scaleMode
+}
+
+// Draw draws the frame to the screen.
+func (d *Display) Draw(screen *ebiten.Image, frame *ebiten.Image) {
+	if d.options.ghosting {
+		frame = d.blend(frame)
+	}
+
+	screenSize, frameSize := screen.Bounds().Size(), frame.Bounds().Size()
+	x, y, width, height := scaledRect(d.options.scaleMode, screenSize.X, screenSize.Y, frameSize.X, frameSize.Y)
+	scaleX, scaleY := float64(width)/float64(frameSize.X), float64(height)/float64(frameSize.Y)
+	grid := d.options.grid && scaleX >= gridMinScale && scaleY >= gridMinScale
+
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Scale(scaleX, scaleY)
+	if !grid && !d.options.colorCorrection {
+		op.GeoM.Translate(float64(x), float64(y))
+		screen.DrawImage(frame, op)
+		return
+	}
+
+	// The LCD shader works on the scaled image, so that the grid can be drawn within each pixel.
+	if d.scaledImage == nil || d.scaledImage.Bounds().Dx() != width || d.scaledImage.Bounds().Dy() != height {
+		if d.scaledImage != nil {
+			d.scaledImage.Deallocate()
+		}
+		d.scaledImage = ebiten.NewImage(width, height)
+	}
+	d.scaledImage.Clear()
+	d.scaledImage.DrawImage(frame, op)
+
+	shaderOp := &ebiten.DrawRectShaderOptions{}
+	shaderOp.GeoM.Translate(float64(x), float64(y))
+	shaderOp.Images[0] = d.scaledImage
+	shaderOp.Uniforms = map[string]any{
+		"Scale":           []float32{float32(scaleX), float32(scaleY)},
+		"GridIntensity":   float32(0),
+		"ColorCorrection": float32(0),
+	}
+	if grid {
+		shaderOp.Uniforms["GridIntensity"] = float32(gridIntensity)
+	}
+	if d.options.colorCorrection {
+		shaderOp.Uniforms["ColorCorrection"] = float32(1)
+	}
+	screen.DrawRectShader(width, height, d.lcdShd, shaderOp)
+}
+
+// blend mixes the frame with the previous output and returns the result.
+func (d *Display) blend(frame *ebiten.Image) *ebiten.Image {
+	size := frame.Bounds().Size()
+	if d.ghostingImage == nil || d.ghostingImage.Bounds().Size() != size {
+		// First frame, or the SGB border has just been shown: nothing to blend with.
+		d.ghostingImage = ebiten.NewImage(size.X, size.Y)
+		d.blendedImage = ebiten.NewImage(size.X, size.Y)
+		d.ghostingImage.DrawImage(frame, nil)
+	}
+
+	op := &ebiten.DrawRectShaderOptions{}
+	op.Images[0] = frame
+	op.Images[1] = d.ghostingImage
+	op.Uniforms = map[string]any{"Persistence": float32(ghostingPersistence)}
+	d.blendedImage.Clear()
+	d.blendedImage.DrawRectShader(size.X, size.Y, d.ghostingShd, op)
+
+	d.ghostingImage, d.blendedImage = d.blendedImage, d.ghostingImage
+	return d.ghostingImage
+}
+
+// scaledRect returns where a frame of the given size is drawn within the screen.
+func scaledRect(mode ScaleMode, screenWidth, screenHeight, frameWidth, frameHeight int) (x, y, width, height int) {
+	scaleX := float64(screenWidth) / float64(frameWidth)
+	scaleY := float64(screenHeight) / float64(frameHeight)
+	switch mode {
+	case ScaleStretch:
+		return 0, 0, screenWidth, screenHeight
+	case ScaleInteger:
+		scale := math.Max(1, math.Floor(math.Min(scaleX, scaleY)))
+		scaleX, scaleY = scale, scale
+	case ScaleFit:
+		scale := math.Min(scaleX, scaleY)
+		scaleX, scaleY = scale, scale
+	}
+	width, height = int(float64(frameWidth)*scaleX), int(float64(frameHeight)*scaleY)
+	return (screenWidth - width) / 2, (screenHeight - height) / 2, width, height
+}
@@ -1,19 +1,81 @@
 package main
 
 import (
+	"fmt"
 	"time"
 )
 
-const clockFreq = 1_048_576
+const (
+	clockFreq = 1_048_576
+	// A frame is 154 lines of 456 dots, and the PPU draws 4 dots per tick.
+	ticksPerFrame = numScanLines * numDotsPerLine / 4
+)
+
+// SyncMode defines what paces the emulator.
+type SyncMode int
+
+const (
+	// SyncVideo runs the emulator at the speed of the original hardware, measured with the system clock.
+	SyncVideo SyncMode = iota
+	// SyncAudio runs the emulator as fast as the audio output consumes the samples, which avoids audio glitches when
+	// sleeping is imprecise. It requires the audio to be played.
+	SyncAudio
+	// SyncNone runs the emulator as fast as possible.
+	SyncNone
+)
+
+var syncModeNames = []string{"video", "audio", "none"}
+
+func (m SyncMode) String() string {
+	return syncModeNames[m]
+}
+
+// ParseSyncMode returns the sync mode with the given name.
+func ParseSyncMode(name string) (SyncMode, error) {
+	for i, modeName := range syncModeNames {
+		if modeName == name {
+			return SyncMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync mode %q", name)
+}
 
 // A Ticker is a system that advances every time Tick is called
 type Ticker interface {
 	Tick()
 }
 
+// PixelSource is the layer a DMG pixel comes from, which also determines the palette used for it.
+type PixelSource byte
+
+const (
+	SourceBackground PixelSource = iota
+	SourceWindow
+	SourceObject0 // Sprite using OBP0
+	SourceObject1 // Sprite using OBP1
+)
+
 // PixelSetter allows to Set the color of a pixel at a given coordinate
 type PixelSetter interface {
-	SetPixel(r int, c int, color byte)
+	// SetPixel sets a DMG pixel, color is a shade between 0 (white) and 3 (black).
+	SetPixel(r int, c int, color byte, source PixelSource)
+	// SetColorPixel sets a CGB pixel, color is in RGB555 format.
+	SetColorPixel(r int, c int, color uint16)
+}
+
+// FrameListener is notified every time the PPU has drawn a whole frame, when entering VBlank.
+type FrameListener interface {
+	OnFrame()
+}
+
+// SampleListener receives the audio samples, as they are produced by the APU.
+type SampleListener interface {
+	OnSample(sample AudioSample)
+}
+
+// ApuWriteListener receives the writes to the APU registers (0xff10-0xff3f), with the APU tick (2Mhz) of each write.
+type ApuWriteListener interface {
+	OnApuWrite(tick int, addr uint16, value byte)
 }
 
 // PressedKeys encapsulate the status of all the keys used in GB
@@ -33,43 +95,122 @@ type Emulator struct {
 	ppu       *Ppu
 	ppuMemory *PpuMemory
 	dma       *OamDma
+	vramDma   *VramDma
 	timer     *Timer
 	joypad    *JoyPad
 	apu       *Apu
+	speed     *SpeedSwitch
+	sync      SyncMode
 }
 
+// EmulatorOptions are the settings of the emulator chosen by the user.
+type EmulatorOptions struct {
+	// Start in debugger mode
+	debug bool
+	// Print every executed instruction
+	trace bool
+	// Use ScanlineRenderer instead of PpuRenderer
+	fastPpu bool
+	// Emulate the Super Game Boy, if the game supports it
+	sgb bool
+	// What paces the emulator in Run
+	sync SyncMode
+	// The cartridge RTC follows the emulated time from rtcEpoch, instead of the system clock, so that runs with the
+	// same inputs are identical.
+	emulatedRtc bool
+}
+
+// The time of the emulated RTC when the emulator starts.
+var rtcEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
 // MakeEmulator creates a new instance of Emulator
-func MakeEmulator(bootRom []byte, rom []byte, debug bool, trace bool, pixelSetter PixelSetter) Emulator {
+func MakeEmulator(bootRom []byte, rom []byte, options EmulatorOptions, pixelSetter PixelSetter) Emulator {
+	cgb := IsCgbRom(rom)
 	interrupts := Interrupts{}
-	apu := Apu{}
+	apu := Apu{cgb: cgb, consumed: make(chan struct{}, 1), fixedSampleRate: options.sync == SyncAudio}
 	joypad := JoyPad{interrupts: &interrupts}
-	ppuMemory := PpuMemory{}
-	timer := Timer{interrupts: &interrupts, apu: &apu}
 
-	mcu := CreateMemory([]IoHandler{&ppuMemory, &joypad, &apu, &interrupts, &timer})
-	cpu := CreateCpu(&mcu, &interrupts, trace)
-	ppu := MakePpu(&mcu, &ppuMemory, &interrupts, pixelSetter)
+	// Keep the original display as listener, the SGB wraps it below.
+	frameListener, _ := pixelSetter.(FrameListener)
+
+	// The SGB can't run CGB games, they run in CGB mode instead.
+	sgb := options.sgb && IsSgbRom(rom) && !cgb
+	if sgb {
+		borderSetter, _ := pixelSetter.(BorderSetter)
+		joypad.sgb = MakeSgb(pixelSetter, borderSetter)
+		pixelSetter = joypad.sgb
+	}
+
+	ppuMemory := MakePpuMemory(cgb)
+	speed := SpeedSwitch{cgb: cgb}
+	timer := Timer{interrupts: &interrupts, apu: &apu, speed: &speed}
+	vramDma := VramDma{ppuMem: &ppuMemory, speed: &speed, cgb: cgb}
+
+	mcu := CreateMemory([]IoHandler{&ppuMemory, &joypad, &apu, &interrupts, &timer, &speed, &vramDma}, cgb)
+	vramDma.mcu = &mcu
+	cpu := CreateCpu(&mcu, &interrupts, &speed, &timer, options.trace)
+	ppu := MakePpu(&mcu, &ppuMemory, &interrupts, &vramDma, pixelSetter, frameListener,
+		options.fastPpu)
 	dma := OamDma{ppuMem: &ppuMemory, mcu: &mcu}
 
 	if len(bootRom) > 0 {
 		mcu.SetBootRom(bootRom)
 	} else {
 		// If no boot rom is given, Set a state similar to the DMG ROM.
-		setDefaultState(cpu, &mcu)
+		setDefaultState(cpu, &mcu, cgb, sgb)
 	}
 	mcu.SetRom(rom)
+	if options.emulatedRtc {
+		// The APU ticks at 2Mhz in both speeds, its tick counts the emulated time.
+		mcu.cartridge.mbc3Clock = func() time.Time {
+			return rtcEpoch.Add(time.Duration(float64(apu.tick) / (clockFreq * 2) * float64(time.Second)))
+		}
+	}
 
 	var cpuRef Ticker = cpu
-	if debug {
-		cpuRef = &Debugger{cpu: cpu, paused: true}
+	if options.debug {
+		cpuRef = &Debugger{cpu: cpu, layers: &ppuMemory.layers, vramViewer: MakeVramViewer(&mcu, &ppuMemory),
+			mutes: &apu.mutes, paused: true}
 	}
 
-	e := Emulator{&mcu, cpuRef, &ppu, &ppuMemory, &dma, &timer, &joypad, &apu}
+	e := Emulator{&mcu, cpuRef, &ppu, &ppuMemory, &dma, &vramDma, &timer, &joypad, &apu, &speed, options.sync}
 	return e
 }
 
-// Run runs the emulator. Blocking.
+// SetSampleListener sets the listener of the audio samples, it must be called before Run.
+func (e *Emulator) SetSampleListener(listener SampleListener) {
+	e.apu.sampleListener = listener
+}
+
+// SetApuWriteListener sets the listener of the writes to the APU registers, it must be called before Run.
+func (e *Emulator) SetApuWriteListener(listener ApuWriteListener) {
+	e.apu.writeListener = listener
+}
+
+// SetDebuggerPalette sets the function returning the palette of the debugger's VRAM dumps, if the debugger is enabled.
+// It must be called before Run.
+func (e *Emulator) SetDebuggerPalette(palette func() *DmgPalette) {
+	if dbg, ok := e.cpu.(*Debugger); ok {
+		dbg.palette = palette
+	}
+}
+
+// Run runs the emulator, paced according to the sync mode. Blocking.
 func (e *Emulator) Run() {
+	switch e.sync {
+	case SyncAudio:
+		e.runSyncAudio()
+	case SyncNone:
+		for {
+			e.Tick()
+		}
+	default:
+		e.runSyncVideo()
+	}
+}
+
+// runSyncVideo runs one tick every 1/clockFreq seconds.
+func (e *Emulator) runSyncVideo() {
 	targetCycleDuration := time.Second / clockFreq
 	startTime := time.Now()
 	var endTime time.Time
@@ -82,11 +223,29 @@ func (e *Emulator) Run() {
 	}
 }
 
+// runSyncAudio runs until the audio output buffer has enough samples, then waits for the audio player to consume
+// some of them.
+func (e *Emulator) runSyncAudio() {
+	for {
+		for e.apu.output.Len() >= audioTargetFill {
+			<-e.apu.consumed
+		}
+		e.Tick()
+	}
+}
+
 // A Tick of the emulator, should be called at 1Mhz for GMB original speed
 func (e *Emulator) Tick() {
-	e.cpu.Tick()
+	// The timer ticks after the CPU, which sees its overflow and reload one tick later, see Timer.
+	e.tickCpu()
 	e.dma.Tick()
 	e.timer.Tick()
+	if e.speed.doubleSpeed {
+		// In CGB double speed mode, the CPU, DMA and timer run twice as fast. The PPU and the APU are not affected.
+		e.tickCpu()
+		e.dma.Tick()
+		e.timer.Tick()
+	}
 	e.apu.Tick()
 	e.apu.Tick()
 
@@ -97,10 +256,25 @@ func (e *Emulator) Tick() {
 	e.ppu.Tick()
 }
 
-func setDefaultState(cpu *Cpu, mcu *Mcu) {
+func (e *Emulator) tickCpu() {
+	if e.vramDma.HaltsCpu() {
+		return
+	}
+	e.cpu.Tick()
+}
+
+func setDefaultState(cpu *Cpu, mcu *Mcu, cgb bool, sgb bool) {
 	// TODO: I believe the DMG rom sets other I/O registers as well.
 	cpu.fc, cpu.fh, cpu.fz = true, true, true
 	cpu.a, cpu.b, cpu.c, cpu.d, cpu.e, cpu.h, cpu.l = 0x01, 0x00, 0x13, 0x00, 0xD8, 0x01, 0x4D
+	if cgb {
+		// Games detect the CGB from the value of A.
+		cpu.fc, cpu.fh = false, false
+		cpu.a, cpu.b, cpu.c, cpu.d, cpu.e, cpu.h, cpu.l = 0x11, 0x00, 0x00, 0xFF, 0x56, 0x00, 0x0D
+	} else if sgb {
+		cpu.fc, cpu.fh, cpu.fz = false, false, false
+		cpu.a, cpu.b, cpu.c, cpu.d, cpu.e, cpu.h, cpu.l = 0x01, 0x00, 0x14, 0x00, 0x00, 0xC0, 0x60
+	}
 	cpu.pc = 0x100
 	mcu.Set(addrLcdControl, 0x91)
 	mcu.Set(addrBgPalette, 0xfc)
@@ -3,38 +3,117 @@ package main
 import (
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"image"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// A palette with black and white colors.
-var palette = [][]byte{
-	{255, 255, 255},
-	{165, 165, 165},
-	{82, 82, 82},
-	{0, 0, 0},
-}
-
 const (
 	audioSampleRate = 48000
 	bytesPerPixel   = 4
 	numPixels       = DisplayWidth * DisplayHeight
 	windowScale     = 3
+	// Position of the game screen within the SGB border.
+	sgbScreenX = (SgbBorderWidth - DisplayWidth) / 2
+	sgbScreenY = (SgbBorderHeight - DisplayHeight) / 2
 	// A bit of a tradeoff: a large buffer size provides more stable audio, but increases the delay between an audio
 	// change and when the new audio is actually played.
 	audioBufferSize = 100 * time.Millisecond
+
+	keyNextPalette           = ebiten.KeyP
+	keyRecordAudio           = ebiten.KeyR
+	keyToggleGhosting        = ebiten.KeyF1
+	keyToggleGrid            = ebiten.KeyF2
+	keyToggleColorCorrection = ebiten.KeyF3
+	keyNextScaleMode         = ebiten.KeyF4
+	keyToggleBackground      = ebiten.KeyF5
+	keyToggleWindow          = ebiten.KeyF6
+	keyToggleObjects         = ebiten.KeyF7
+	keyToggleTint            = ebiten.KeyF8
+	keyNextDebugView         = ebiten.KeyF9
+	keyRecordVideo           = ebiten.KeyF10
+	keyWindowScreenshot      = ebiten.KeyF11
+	keyScreenshot            = ebiten.KeyF12
+	// When playing a music file.
+	keyNextTrack     = ebiten.KeyRight
+	keyPreviousTrack = ebiten.KeyLeft
+	// Keys 1-4 mute a channel, or solo it if this is held.
+	keySoloModifier = ebiten.KeyShiftLeft
 )
 
+// TrackPlayer plays a music file, made of several tracks.
+type TrackPlayer interface {
+	NextTrack()
+	PreviousTrack()
+	// TrackInfo returns lines of text describing the file and the current track.
+	TrackInfo() []string
+}
+
 type Game struct {
 	pixels       [numPixels * bytesPerPixel]byte
 	keysListener KeysListener
+	// When playing a music file, the window shows the track instead of the screen.
+	trackPlayer TrackPlayer
+	// Palettes to color DMG games, the one in use can be changed at runtime. The index is read by the emulator
+	// goroutine.
+	palettes     []DmgPalette
+	paletteIndex atomic.Int32
+	// SGB border, drawn around the screen if the game sets it.
+	border      [SgbBorderWidth * SgbBorderHeight * bytesPerPixel]byte
+	hasBorder   bool
+	borderShown bool
+	screenImage *ebiten.Image
+	// The frame to display: the screen, or the screen within the SGB border.
+	frameImage *ebiten.Image
+	display    *Display
+	// Debug settings of the PPU and the APU.
+	layers *Layers
+	mutes  *ChannelMutes
+	// VRAM viewers, shown instead of the game.
+	vramViewer        *VramViewer
+	debugView         DebugView
+	debugImage        *ebiten.Image
+	spritesPanelImage *ebiten.Image
+	audioPanelImage   *ebiten.Image
+	oscilloscope      *Oscilloscope
+	// Screenshots are named after the game.
+	romTitle   string
+	frameCount int
+	// Take a screenshot when this frame is drawn and exit, if > 0.
+	screenshotFrame int
+	screenshotPath  string
+	screenshotScale int
+	// Set from the emulator goroutine to end the game, which stops the recordings.
+	exitRequested atomic.Bool
+	// Capture the window, with filters and scaling, on the next Draw.
+	windowScreenshotRequested bool
+	// The video, audio and APU writes being recorded, if any. They are added from the emulator goroutine.
+	videoRecorder *VideoRecorder
+	audioRecorder *AudioRecorder
+	vgmRecorder   *VgmRecorder
+	// Whether audio recordings include a file per channel.
+	audioStems   bool
+	recordersMu  sync.Mutex
 	audioStream  io.Reader
 	audioContext *audio.Context
 	audioPlayer  *audio.Player
 }
 
 func (g *Game) Update() error {
+	if g.exitRequested.Load() {
+		return ebiten.Termination
+	}
+	if g.hasBorder && !g.borderShown {
+		// Make room for the border.
+		ebiten.SetWindowSize(SgbBorderWidth*windowScale, SgbBorderHeight*windowScale)
+		g.borderShown = true
+	}
+
 	if g.audioPlayer == nil && g.audioStream != nil {
 		var err error
 		g.audioPlayer, err = g.audioContext.NewPlayerF32(g.audioStream)
@@ -45,6 +124,79 @@ func (g *Game) Update() error {
 		g.audioPlayer.Play()
 	}
 
+	if inpututil.IsKeyJustPressed(keyNextPalette) {
+		g.paletteIndex.Store((g.paletteIndex.Load() + 1) % int32(len(g.palettes)))
+		log.Printf("Palette: %s", g.Palette().name)
+	}
+	if inpututil.IsKeyJustPressed(keyToggleGhosting) {
+		g.display.ToggleGhosting()
+	}
+	if inpututil.IsKeyJustPressed(keyToggleGrid) {
+		g.display.ToggleGrid()
+	}
+	if inpututil.IsKeyJustPressed(keyToggleColorCorrection) {
+		g.display.ToggleColorCorrection()
+	}
+	if inpututil.IsKeyJustPressed(keyNextScaleMode) {
+		log.Printf("Scale mode: %v", g.display.NextScaleMode())
+	}
+	if inpututil.IsKeyJustPressed(keyScreenshot) {
+		pixels, width, height := g.framePixels()
+		g.saveScreenshot(rgbaImage(pixels, width, height, 1), captureFileName(g.romTitle, time.Now(), "png"))
+	}
+	if g.layers != nil {
+		layerKeys := map[ebiten.Key]Layer{
+			keyToggleBackground: LayerBackground,
+			keyToggleWindow:     LayerWindow,
+			keyToggleObjects:    LayerObjects,
+		}
+		for key, layer := range layerKeys {
+			if inpututil.IsKeyJustPressed(key) {
+				g.layers.Toggle(layer)
+				log.Printf("Layers: %v", g.layers)
+			}
+		}
+		if inpututil.IsKeyJustPressed(keyToggleTint) {
+			g.layers.ToggleTint()
+			log.Printf("Layers: %v", g.layers)
+		}
+	}
+	if g.mutes != nil {
+		channelKeys := []ebiten.Key{ebiten.Key1, ebiten.Key2, ebiten.Key3, ebiten.Key4}
+		for chNum, key := range channelKeys {
+			if !inpututil.IsKeyJustPressed(key) {
+				continue
+			}
+			if ebiten.IsKeyPressed(keySoloModifier) {
+				g.mutes.ToggleSolo(chNum)
+			} else {
+				g.mutes.ToggleMute(chNum)
+			}
+			log.Printf("Audio channels: %v", g.mutes)
+		}
+	}
+	if g.vramViewer != nil && inpututil.IsKeyJustPressed(keyNextDebugView) {
+		g.debugView = (g.debugView + 1) % numDebugViews
+		log.Printf("View: %v", g.debugView)
+	}
+	if inpututil.IsKeyJustPressed(keyRecordVideo) {
+		g.ToggleVideoRecording("")
+	}
+	if inpututil.IsKeyJustPressed(keyRecordAudio) {
+		g.ToggleAudioRecording("")
+	}
+	if inpututil.IsKeyJustPressed(keyWindowScreenshot) {
+		g.windowScreenshotRequested = true
+	}
+	if g.trackPlayer != nil {
+		if inpututil.IsKeyJustPressed(keyNextTrack) {
+			g.trackPlayer.NextTrack()
+		}
+		if inpututil.IsKeyJustPressed(keyPreviousTrack) {
+			g.trackPlayer.PreviousTrack()
+		}
+	}
+
 	if g.keysListener != nil {
 		keys := PressedKeys{
 			ebiten.IsKeyPressed(ebiten.KeyUp),
@@ -62,22 +214,317 @@ func (g *Game) Update() error {
 }
 
 func (g *Game) Draw(screen *ebiten.Image) {
-	screen.WritePixels(g.pixels[:])
+	switch {
+	case g.debugView != ViewGame:
+		g.drawDebugView(screen)
+	case g.trackPlayer != nil:
+		g.drawTrackInfo(screen)
+	default:
+		g.drawGame(screen)
+	}
+
+	if g.windowScreenshotRequested {
+		g.windowScreenshotRequested = false
+		size := screen.Bounds().Size()
+		pixels := make([]byte, size.X*size.Y*bytesPerPixel)
+		screen.ReadPixels(pixels)
+		g.saveScreenshot(rgbaImage(pixels, size.X, size.Y, 1), captureFileName(g.romTitle, time.Now(), "png"))
+	}
+}
+
+func (g *Game) drawGame(screen *ebiten.Image) {
+	g.screenImage.WritePixels(g.pixels[:])
+	frame := g.screenImage
+	if g.borderShown {
+		if g.frameImage == nil {
+			g.frameImage = ebiten.NewImage(SgbBorderWidth, SgbBorderHeight)
+		}
+		g.frameImage.WritePixels(g.border[:])
+		op := &ebiten.DrawImageOptions{}
+		op.GeoM.Translate(sgbScreenX, sgbScreenY)
+		g.frameImage.DrawImage(g.screenImage, op)
+		frame = g.frameImage
+	}
+	g.display.Draw(screen, frame)
+}
+
+// drawTrackInfo shows the music file being played, and how to change track.
+func (g *Game) drawTrackInfo(screen *ebiten.Image) {
+	screen.Fill(debugBackgroundColor)
+	lines := append(g.trackPlayer.TrackInfo(), "", "Left/Right: previous/next track")
+	for i, line := range lines {
+		ebitenutil.DebugPrintAt(screen, line, spritesPanelMargin, spritesPanelMargin+i*debugTextHeight)
+	}
 }
 
-func (g *Game) Layout(int, int) (screenWidth int, screenHeight int) {
-	return DisplayWidth, DisplayHeight
+func (g *Game) Layout(outsideWidth int, outsideHeight int) (screenWidth int, screenHeight int) {
+	// The whole window is used, the display scales the frame to fit.
+	return outsideWidth, outsideHeight
 }
 
 func (g *Game) Run() {
-	if err := ebiten.RunGame(g); err != nil {
+	err := ebiten.RunGame(g)
+	g.recordersMu.Lock()
+	if g.videoRecorder != nil {
+		g.stopVideoRecording()
+	}
+	if g.audioRecorder != nil {
+		g.stopAudioRecording()
+	}
+	if g.vgmRecorder != nil {
+		g.stopVgmRecording()
+	}
+	g.recordersMu.Unlock()
+	if err != nil {
 		log.Fatalf("Game failed to start: %v", err)
 	}
 }
 
-func (g *Game) SetPixel(r int, c int, color byte) {
+func (g *Game) SetPixel(r int, c int, color byte, source PixelSource) {
+	pixelIndex := (r*DisplayWidth + c) * bytesPerPixel
+	colors := g.Palette().colors(source)
+	copy(g.pixels[pixelIndex:pixelIndex+3], colors[color][:])
+}
+
+// OnFrame is called by the emulator every time a frame has been drawn.
+func (g *Game) OnFrame() {
+	g.frameCount++
+	g.recordersMu.Lock()
+	if g.videoRecorder != nil {
+		if err := g.videoRecorder.AddFrame(g.pixels[:]); err != nil {
+			log.Printf("Failed to record video: %v", err)
+			g.stopVideoRecording()
+		}
+	}
+	g.recordersMu.Unlock()
+
+	if g.frameCount == g.screenshotFrame {
+		pixels, width, height := g.framePixels()
+		g.saveScreenshot(rgbaImage(pixels, width, height, g.screenshotScale), g.screenshotPath)
+		g.exitRequested.Store(true)
+	}
+}
+
+// OnSample is called by the emulator every time an audio sample is produced.
+func (g *Game) OnSample(sample AudioSample) {
+	if g.oscilloscope != nil {
+		g.oscilloscope.AddSample(sample)
+	}
+	g.recordersMu.Lock()
+	if g.videoRecorder != nil {
+		if err := g.videoRecorder.AddSample(sample); err != nil {
+			log.Printf("Failed to record video: %v", err)
+			g.stopVideoRecording()
+		}
+	}
+	if g.audioRecorder != nil {
+		if err := g.audioRecorder.AddSample(sample); err != nil {
+			log.Printf("Failed to record audio: %v", err)
+			g.stopAudioRecording()
+		}
+	}
+	g.recordersMu.Unlock()
+}
+
+// OnApuWrite is called by the emulator every time an APU register is written.
+func (g *Game) OnApuWrite(tick int, addr uint16, value byte) {
+	g.recordersMu.Lock()
+	if g.vgmRecorder != nil {
+		if err := g.vgmRecorder.AddWrite(tick, addr, value); err != nil {
+			log.Printf("Failed to record VGM: %v", err)
+			g.stopVgmRecording()
+		}
+	}
+	g.recordersMu.Unlock()
+}
+
+// StartVgmRecording starts recording the writes to the APU registers to the given VGM file. It should be called before
+// the emulator starts, since the file doesn't contain the state of the APU before the recording.
+func (g *Game) StartVgmRecording(path string, tags VgmTags) {
+	g.recordersMu.Lock()
+	defer g.recordersMu.Unlock()
+	recorder, err := StartVgmRecording(path, tags)
+	if err != nil {
+		log.Printf("Failed to start VGM recording: %v", err)
+		return
+	}
+	g.vgmRecorder = recorder
+	log.Printf("Recording VGM to %s", path)
+}
+
+func (g *Game) stopVgmRecording() {
+	if err := g.vgmRecorder.Close(); err != nil {
+		log.Printf("Failed to save VGM: %v", err)
+	} else {
+		log.Printf("VGM recording stopped")
+	}
+	g.vgmRecorder = nil
+}
+
+// ToggleVideoRecording starts recording a video to the given Y4M file (named after the game if empty), or stops the
+// recording in progress.
+func (g *Game) ToggleVideoRecording(path string) {
+	g.recordersMu.Lock()
+	defer g.recordersMu.Unlock()
+	if g.videoRecorder != nil {
+		g.stopVideoRecording()
+		return
+	}
+
+	if len(path) == 0 {
+		path = captureFileName(g.romTitle, time.Now(), "y4m")
+	}
+	recorder, err := StartVideoRecording(path)
+	if err != nil {
+		log.Printf("Failed to start video recording: %v", err)
+		return
+	}
+	g.videoRecorder = recorder
+	log.Printf("Recording video to %s", path)
+}
+
+// stopVideoRecording must be called with recordersMu locked.
+func (g *Game) stopVideoRecording() {
+	if err := g.videoRecorder.Close(); err != nil {
+		log.Printf("Failed to save video: %v", err)
+	} else {
+		log.Printf("Video recording stopped")
+	}
+	g.videoRecorder = nil
+}
+
+// ToggleAudioRecording starts recording the audio to the given WAV file (named after the game if empty), or stops the
+// recording in progress.
+func (g *Game) ToggleAudioRecording(path string) {
+	g.recordersMu.Lock()
+	defer g.recordersMu.Unlock()
+	if g.audioRecorder != nil {
+		g.stopAudioRecording()
+		return
+	}
+
+	if len(path) == 0 {
+		path = captureFileName(g.romTitle, time.Now(), "wav")
+	}
+	recorder, err := StartAudioRecording(path, g.audioStems)
+	if err != nil {
+		log.Printf("Failed to start audio recording: %v", err)
+		return
+	}
+	g.audioRecorder = recorder
+	log.Printf("Recording audio to %s", path)
+}
+
+// stopAudioRecording must be called with recordersMu locked.
+func (g *Game) stopAudioRecording() {
+	if err := g.audioRecorder.Close(); err != nil {
+		log.Printf("Failed to save audio: %v", err)
+	} else {
+		log.Printf("Audio recording stopped")
+	}
+	g.audioRecorder = nil
+}
+
+// SetAudioStems sets whether audio recordings include a file per channel.
+func (g *Game) SetAudioStems(stems bool) {
+	g.audioStems = stems
+}
+
+// framePixels returns the RGBA pixels of the current frame, at native resolution, and its size.
+func (g *Game) framePixels() ([]byte, int, int) {
+	if !g.borderShown {
+		return g.pixels[:], DisplayWidth, DisplayHeight
+	}
+	pixels := make([]byte, len(g.border))
+	copy(pixels, g.border[:])
+	for r := 0; r < DisplayHeight; r++ {
+		start := ((r+sgbScreenY)*SgbBorderWidth + sgbScreenX) * bytesPerPixel
+		copy(pixels[start:start+DisplayWidth*bytesPerPixel], g.pixels[r*DisplayWidth*bytesPerPixel:])
+	}
+	return pixels, SgbBorderWidth, SgbBorderHeight
+}
+
+func (g *Game) saveScreenshot(img image.Image, path string) {
+	if err := SavePng(img, path); err != nil {
+		log.Printf("Failed to save screenshot: %v", err)
+		return
+	}
+	log.Printf("Screenshot saved to %s", path)
+}
+
+// SetLayers sets the PPU layers, which can be toggled with hotkeys.
+func (g *Game) SetLayers(layers *Layers) {
+	g.layers = layers
+}
+
+// SetChannelMutes sets the APU channel mutes, which can be toggled with hotkeys.
+func (g *Game) SetChannelMutes(mutes *ChannelMutes) {
+	g.mutes = mutes
+}
+
+// SetVramViewer sets the viewer used to show the content of VRAM instead of the game.
+func (g *Game) SetVramViewer(viewer *VramViewer) {
+	g.vramViewer = viewer
+}
+
+// SetRomTitle sets the title of the game, used to name screenshots.
+func (g *Game) SetRomTitle(title string) {
+	g.romTitle = title
+}
+
+// SetScreenshotAtFrame makes the game save a screenshot when the given frame (starting from 1) is drawn, and end.
+// The screenshot is scaled by the given factor, and named after the game if path is empty.
+func (g *Game) SetScreenshotAtFrame(frame int, path string, scale int) {
+	g.screenshotFrame = frame
+	g.screenshotPath = path
+	if len(path) == 0 {
+		g.screenshotPath = captureFileName(g.romTitle, time.Now(), "png")
+	}
+	g.screenshotScale = scale
+}
+
+// SetPalettes sets the palettes that can be used for DMG games, and the one in use.
+func (g *Game) SetPalettes(palettes []DmgPalette, index int) {
+	g.palettes = palettes
+	g.paletteIndex.Store(int32(index))
+}
+
+// Palette returns the palette in use for DMG games.
+func (g *Game) Palette() *DmgPalette {
+	return &g.palettes[g.paletteIndex.Load()]
+}
+
+func (g *Game) SetColorPixel(r int, c int, color uint16) {
 	pixelIndex := (r*DisplayWidth + c) * bytesPerPixel
-	copy(g.pixels[pixelIndex:pixelIndex+3], palette[color])
+	g.pixels[pixelIndex] = rgb555To888(color)
+	g.pixels[pixelIndex+1] = rgb555To888(color >> 5)
+	g.pixels[pixelIndex+2] = rgb555To888(color >> 10)
+}
+
+func (g *Game) SetBorder(border *[SgbBorderWidth * SgbBorderHeight]uint16) {
+	for i, color := range border {
+		g.border[i*bytesPerPixel] = rgb555To888(color)
+		g.border[i*bytesPerPixel+1] = rgb555To888(color >> 5)
+		g.border[i*bytesPerPixel+2] = rgb555To888(color >> 10)
+		g.border[i*bytesPerPixel+3] = 0xff
+	}
+	g.hasBorder = true
+}
+
+// rgb555To888 converts the 5 lowest bits of a RGB555 color to an 8-bit channel.
+func rgb555To888(v uint16) byte {
+	v &= 0x1f
+	return byte(v<<3 | v>>2)
+}
+
+// SetOscilloscope sets the oscilloscope shown by the audio debug view.
+func (g *Game) SetOscilloscope(oscilloscope *Oscilloscope) {
+	g.oscilloscope = oscilloscope
+}
+
+// SetTrackPlayer sets the player of the music file being played, its tracks can be changed with hotkeys.
+func (g *Game) SetTrackPlayer(player TrackPlayer) {
+	g.trackPlayer = player
 }
 
 func (g *Game) SetKeysListener(listener KeysListener) {
@@ -88,10 +535,20 @@ func (g *Game) SetAudioStream(audioStream io.Reader) {
 	g.audioStream = audioStream
 }
 
-func MakeGame() *Game {
-	game := Game{}
+func MakeGame(displayOptions DisplayOptions) *Game {
+	display, err := MakeDisplay(displayOptions)
+	if err != nil {
+		log.Fatalf("Failed to create display: %v", err)
+	}
+	game := Game{palettes: dmgPalettes, display: display}
+	for i := 3; i < len(game.pixels); i += bytesPerPixel {
+		// Pixels are opaque, so that the screen can be drawn on top of the SGB border.
+		game.pixels[i] = 0xff
+	}
+	game.screenImage = ebiten.NewImage(DisplayWidth, DisplayHeight)
 	game.audioContext = audio.NewContext(audioSampleRate)
 	ebiten.SetWindowSize(DisplayWidth*windowScale, DisplayHeight*windowScale)
 	ebiten.SetWindowTitle("Good Boy")
+	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
 	return &game
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	gbsHeaderSize = 0x70
+	gbsFieldSize  = 32
+	// The GBS data can't be loaded below this address, the driver code goes there.
+	gbsMinLoadAddr = 0x400
+	// The data must fit in the banks of an MBC3.
+	gbsMaxRomSize = 128 * 0x4000
+	// Where the driver code starts, after the cartridge header.
+	gbsDriverInit = 0x150
+)
+
+// GbsFile is a Game Boy Sound System file: the music code and data ripped from a game, with the routines to start a
+// song and to play it. See https://ocremix.org/info/GBS_Format_Specification.
+type GbsFile struct {
+	numSongs  int
+	firstSong int // 1-based
+	// Where the data is loaded, the routine that starts a song (the song number is in A) and the one that plays it,
+	// called at every VBlank or timer interrupt.
+	loadAddr     uint16
+	initAddr     uint16
+	playAddr     uint16
+	stackPointer uint16
+	// If the timer is enabled in timerControl, the play routine is called by the timer interrupt instead of VBlank.
+	timerModulo  byte
+	timerControl byte
+	title        string
+	author       string
+	copyright    string
+	data         []byte
+}
+
+// IsGbsFile returns whether the file is a GBS file, according to its header.
+func IsGbsFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GBS"))
+}
+
+// ParseGbs parses the header of a GBS file.
+func ParseGbs(data []byte) (*GbsFile, error) {
+	if len(data) < gbsHeaderSize || !IsGbsFile(data) {
+		return nil, errors.New("not a GBS file")
+	}
+	if data[3] != 1 {
+		return nil, fmt.Errorf("unsupported GBS version %d", data[3])
+	}
+	gbs := &GbsFile{
+		numSongs:     int(data[4]),
+		firstSong:    int(data[5]),
+		loadAddr:     merge(data[7], data[6]),
+		initAddr:     merge(data[9], data[8]),
+		playAddr:     merge(data[0xb], data[0xa]),
+		stackPointer: merge(data[0xd], data[0xc]),
+		timerModulo:  data[0xe],
+		timerControl: data[0xf],
+		title:        gbsString(data[0x10:]),
+		author:       gbsString(data[0x30:]),
+		copyright:    gbsString(data[0x50:]),
+		data:         data[gbsHeaderSize:],
+	}
+	if gbs.numSongs == 0 {
+		return nil, errors.New("the GBS file has no songs")
+	}
+	if gbs.firstSong < 1 || gbs.firstSong > gbs.numSongs {
+		gbs.firstSong = 1
+	}
+	if gbs.loadAddr < gbsMinLoadAddr || gbs.loadAddr >= addrRomEnd {
+		return nil, fmt.Errorf("invalid GBS load address 0x%04x", gbs.loadAddr)
+	}
+	if int(gbs.loadAddr)+len(gbs.data) > gbsMaxRomSize {
+		return nil, fmt.Errorf("the GBS data is too large: %d bytes", len(gbs.data))
+	}
+	return gbs, nil
+}
+
+// gbsString returns a text field of the header, padded with zeros.
+func gbsString(field []byte) string {
+	field = field[:gbsFieldSize]
+	if end := bytes.IndexByte(field, 0); end >= 0 {
+		field = field[:end]
+	}
+	return strings.TrimSpace(string(field))
+}
+
+// Rom returns a cartridge that plays the GBS file: an MBC3 with RAM, with the data at the load address and a driver
+// that starts the song whose number is in A, then calls the play routine at every interrupt.
+func (g *GbsFile) Rom() []byte {
+	size, sizeCode := 0x8000, byte(0)
+	for size < int(g.loadAddr)+len(g.data) {
+		size *= 2
+		sizeCode++
+	}
+	rom := make([]byte, size)
+	copy(rom[g.loadAddr:], g.data)
+
+	// The RST instructions jump to the load address, plus their usual address.
+	for rst := uint16(0); rst <= 0x38; rst += 8 {
+		writeOpcodes(rom, rst, 0xc3, byte(g.loadAddr+rst), byte((g.loadAddr+rst)>>8)) // JP loadAddr+rst
+	}
+	writeOpcodes(rom, 0x100, 0x00, 0xc3, gbsDriverInit&0xff, gbsDriverInit>>8) // NOP, JP init
+
+	// Header
+	copy(rom[addrTitle:addrTitle+maxTitleSize-1], g.title)
+	rom[0x147] = 0x13 // MBC3+RAM+BATTERY
+	rom[0x148] = sizeCode
+	rom[0x149] = 0x02 // 8KB of RAM
+
+	// Index of the interrupt that calls the play routine: VBlank or, if enabled, the timer.
+	interrupt := 0
+	if isBitSet(g.timerControl, 2) {
+		interrupt = 2
+	}
+	driver := []byte{
+		0xf3,                                                  // DI
+		0x31, byte(g.stackPointer), byte(g.stackPointer >> 8), // LD SP, stackPointer
+		0x5f, // LD E, A (the song number)
+		// Enable the cartridge RAM, GbsPlayer clears it with the WRAM.
+		0x3e, 0x0a, // LD A, 0x0a
+		0xea, 0x00, 0x00, // LD (0x0000), A
+		// Reset the APU, with all the channels at full volume on both outputs.
+		0xaf,       // XOR A
+		0xe0, 0x26, // LDH (NR52), A
+		0x3e, 0x80, // LD A, 0x80
+		0xe0, 0x26, // LDH (NR52), A
+		0x3e, 0xff, // LD A, 0xff
+		0xe0, 0x25, // LDH (NR51), A
+		0x3e, 0x77, // LD A, 0x77
+		0xe0, 0x24, // LDH (NR50), A
+		// Set the timer. Bit 7 of the timer control selects the CGB double speed, which is not supported.
+		0x3e, g.timerModulo, // LD A, timerModulo
+		0xe0, 0x06, // LDH (TMA), A
+		0x3e, g.timerControl & 0x7, // LD A, timerControl
+		0xe0, 0x07, // LDH (TAC), A
+		// Select ROM bank 1.
+		0x3e, 0x01, // LD A, 0x01
+		0xea, 0x00, 0x20, // LD (0x2000), A
+		// Enable the interrupt that calls the play routine.
+		0xaf,       // XOR A
+		0xe0, 0x0f, // LDH (IF), A
+		0x3e, 1 << interrupt, // LD A, 1 << interrupt
+		0xe0, 0xff, // LDH (IE), A
+		// Start the song, then wait for interrupts.
+		0x7b,                                          // LD A, E
+		0xcd, byte(g.initAddr), byte(g.initAddr >> 8), // CALL init
+		0xfb,       // EI
+		0x76,       // HALT
+		0x18, 0xfd, // JR -3
+	}
+	writeOpcodes(rom, gbsDriverInit, driver...)
+
+	// The interrupt handler calls the play routine, saving the registers.
+	playHandler := gbsDriverInit + uint16(len(driver))
+	writeOpcodes(rom, playHandler,
+		0xf5, 0xc5, 0xd5, 0xe5, // PUSH AF, BC, DE, HL
+		0xcd, byte(g.playAddr), byte(g.playAddr>>8), // CALL play
+		0xe1, 0xd1, 0xc1, 0xf1, // POP HL, DE, BC, AF
+		0xd9, // RETI
+	)
+	writeOpcodes(rom, interruptAddresses[interrupt], 0xc3, byte(playHandler), byte(playHandler>>8)) // JP playHandler
+	return rom
+}
+
+func writeOpcodes(rom []byte, addr uint16, opcodes ...byte) {
+	copy(rom[addr:], opcodes)
+}
+
+// GbsPlayer plays the songs of a GBS file, running the driver of GbsFile.Rom. It wraps the CPU, so that a new song
+// starts between two CPU ticks.
+type GbsPlayer struct {
+	gbs    *GbsFile
+	cpu    *Cpu
+	mcu    *Mcu
+	ticker Ticker
+	// The song being played (0-based), and the one to start at the next tick (-1 if none).
+	track          atomic.Int32
+	requestedTrack atomic.Int32
+}
+
+// MakeGbsPlayer makes the emulator play the GBS file, whose Rom it must be running, starting from the first song.
+func MakeGbsPlayer(gbs *GbsFile, emulator *Emulator) *GbsPlayer {
+	p := &GbsPlayer{gbs: gbs, mcu: emulator.mcu, ticker: emulator.cpu}
+	switch cpu := emulator.cpu.(type) {
+	case *Cpu:
+		p.cpu = cpu
+	case *Debugger:
+		p.cpu = cpu.cpu
+	}
+	emulator.cpu = p
+	p.setTrack(gbs.firstSong - 1)
+	return p
+}
+
+func (p *GbsPlayer) Tick() {
+	// Loading is cheaper than swapping, and there's rarely a request.
+	if p.requestedTrack.Load() >= 0 {
+		p.startTrack(int(p.requestedTrack.Swap(-1)))
+	}
+	p.ticker.Tick()
+}
+
+// NextTrack starts the next song, or the first one after the last.
+func (p *GbsPlayer) NextTrack() {
+	p.setTrack((int(p.track.Load()) + 1) % p.gbs.numSongs)
+}
+
+// PreviousTrack starts the previous song, or the last one before the first.
+func (p *GbsPlayer) PreviousTrack() {
+	p.setTrack((int(p.track.Load()) + p.gbs.numSongs - 1) % p.gbs.numSongs)
+}
+
+// TrackInfo returns lines describing the GBS file and the song being played.
+func (p *GbsPlayer) TrackInfo() []string {
+	return []string{
+		p.gbs.title,
+		p.gbs.author,
+		p.gbs.copyright,
+		"",
+		fmt.Sprintf("Track %d/%d", p.track.Load()+1, p.gbs.numSongs),
+	}
+}
+
+func (p *GbsPlayer) setTrack(track int) {
+	p.track.Store(int32(track))
+	p.requestedTrack.Store(int32(track))
+}
+
+// startTrack interrupts whatever the CPU is doing, and runs the driver for the given song. The RAM is cleared here,
+// since a loop in the driver would take several frames, so that the song doesn't see the state of the previous one.
+func (p *GbsPlayer) startTrack(track int) {
+	p.mcu.wram = [8][4 * 1024]byte{}
+	p.mcu.hram = [127]byte{}
+	clear(p.mcu.cartridge.fullRam)
+	// The driver enables the interrupt it needs.
+	p.mcu.Set(addrInterruptEnable, 0)
+
+	p.cpu.pendingOps = nil
+	p.cpu.paused = false
+	p.cpu.ime = false
+	p.cpu.a = byte(track)
+	p.cpu.pc = gbsDriverInit
+}
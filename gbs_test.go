@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// makeTestGbs returns a GBS file with 3 songs, loaded at 0x400. The init routine saves A at 0xc000 and SP at 0xc002,
+// the play routine increments 0xc001.
+func makeTestGbs(timerModulo byte, timerControl byte) []byte {
+	data := make([]byte, gbsHeaderSize)
+	copy(data, "GBS")
+	data[3] = 1                       // Version
+	data[4] = 3                       // Number of songs
+	data[5] = 2                       // First song
+	data[7] = 0x04                    // Load address 0x400
+	data[9] = 0x04                    // Init address 0x400
+	data[0xa], data[0xb] = 0x10, 0x04 // Play address 0x410
+	data[0xc], data[0xd] = 0xfe, 0xdf // Stack pointer 0xdffe
+	data[0xe], data[0xf] = timerModulo, timerControl
+	copy(data[0x10:], "Title")
+	copy(data[0x30:], "Author")
+	copy(data[0x50:], "Copyright")
+
+	code := make([]byte, 0x20)
+	copy(code, []byte{
+		0xea, 0x00, 0xc0, // LD (0xc000), A
+		0x08, 0x02, 0xc0, // LD (0xc002), SP
+		0xc9, // RET
+	})
+	copy(code[0x10:], []byte{
+		0x21, 0x01, 0xc0, // LD HL, 0xc001
+		0x34, // INC (HL)
+		0xc9, // RET
+	})
+	return append(data, code...)
+}
+
+// runGbs plays the GBS file for the given number of frames, from the first song or, if track >= 0, from that song.
+func runGbs(t *testing.T, data []byte, track int, frames int) *Mcu {
+	gbs, err := ParseGbs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator := MakeEmulator(nil, gbs.Rom(), EmulatorOptions{}, headlessDisplay{})
+	player := MakeGbsPlayer(gbs, &emulator)
+	if track >= 0 {
+		player.setTrack(track)
+	}
+	for i := 0; i < frames*ticksPerFrame; i++ {
+		emulator.Tick()
+	}
+	return emulator.mcu
+}
+
+func TestGbsDriver(t *testing.T) {
+	mcu := runGbs(t, makeTestGbs(0, 0), -1, 1)
+	if got := mcu.Get(0xc000); got != 1 {
+		t.Errorf("Init got A=%d, want the first song, 1", got)
+	}
+	// The return address of the call to init is on the stack.
+	if got := merge(mcu.Get(0xc003), mcu.Get(0xc002)); got != 0xdffc {
+		t.Errorf("SP in init is 0x%04x, want 0xdffc", got)
+	}
+	for _, reg := range []struct {
+		name string
+		addr uint16
+		want byte
+	}{
+		{"NR50", addrNr50, 0x77},
+		{"NR51", addrNr51, 0xff},
+		{"NR52", addrNr52, 0xf0},
+		{"IE", addrInterruptEnable, 0xe1},
+	} {
+		if got := mcu.Get(reg.addr); got != reg.want {
+			t.Errorf("%s is 0x%02x, want 0x%02x", reg.name, got, reg.want)
+		}
+	}
+
+	mcu = runGbs(t, makeTestGbs(0, 0), 2, 1)
+	if got := mcu.Get(0xc000); got != 2 {
+		t.Errorf("Init got A=%d, want the selected song, 2", got)
+	}
+}
+
+func TestGbsPlayRate(t *testing.T) {
+	const frames = 10
+	tests := []struct {
+		name                      string
+		timerModulo, timerControl byte
+		wantPlays                 int
+	}{
+		{"VBlank", 0, 0, frames},
+		{"VBlank, timer disabled", 0, 0x01, frames},
+		// TIMA is incremented every 4 M-cycles and overflows every 1024.
+		{"timer", 0, 0x05, frames * ticksPerFrame / 1024},
+		// TIMA is incremented every 64 M-cycles. It starts from 0, then it is reloaded with 0xc0 and overflows every
+		// 4096.
+		{"timer with modulo", 0xc0, 0x07, (frames*ticksPerFrame-256*64)/4096 + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mcu := runGbs(t, makeTestGbs(tt.timerModulo, tt.timerControl), -1, frames)
+			if got := int(mcu.Get(0xc001)); got < tt.wantPlays-1 || got > tt.wantPlays+1 {
+				t.Errorf("The play routine was called %d times, want %d", got, tt.wantPlays)
+			}
+		})
+	}
+}
+
+func TestParseGbs(t *testing.T) {
+	data := makeTestGbs(0x12, 0x04)
+	gbs, err := ParseGbs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GbsFile{numSongs: 3, firstSong: 2, loadAddr: 0x400, initAddr: 0x400, playAddr: 0x410,
+		stackPointer: 0xdffe, timerModulo: 0x12, timerControl: 0x04, title: "Title", author: "Author",
+		copyright: "Copyright", data: data[gbsHeaderSize:]}
+	if !reflect.DeepEqual(*gbs, want) {
+		t.Errorf("Parsed %+v, want %+v", *gbs, want)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(data []byte) []byte
+	}{
+		{"too short", func(data []byte) []byte { return data[:gbsHeaderSize-1] }},
+		{"not a GBS file", func(data []byte) []byte { data[0] = 'X'; return data }},
+		{"unsupported version", func(data []byte) []byte { data[3] = 2; return data }},
+		{"no songs", func(data []byte) []byte { data[4] = 0; return data }},
+		{"load address in the driver", func(data []byte) []byte { data[7] = 0x03; return data }},
+		{"load address after the ROM", func(data []byte) []byte { data[7] = 0x80; return data }},
+		{"data too large", func(data []byte) []byte { return append(data, make([]byte, gbsMaxRomSize)...) }},
+	}
+	for _, tt := range tests {
+		if _, err := ParseGbs(tt.modify(makeTestGbs(0, 0))); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	// An invalid first song starts from the first one.
+	data = makeTestGbs(0, 0)
+	data[5] = 4
+	if gbs, err := ParseGbs(data); err != nil || gbs.firstSong != 1 {
+		t.Errorf("First song is %d, error %v, want 1", gbs.firstSong, err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// InputEvent sets the keys that are pressed, from a frame on.
+type InputEvent struct {
+	frame int
+	keys  PressedKeys
+}
+
+// LoadInputScript reads input events from a text file. Each line has a frame number, in increasing order, followed by
+// the keys pressed from that frame on (up, down, left, right, a, b, start, select), none to release all the keys.
+// Empty lines and lines starting with # are ignored. For example, to press start at frame 60 for 5 frames:
+//
+//	60 start
+//	65
+//	120 a right
+func LoadInputScript(path string) ([]InputEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []InputEvent
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil || frame < 0 {
+			return nil, fmt.Errorf("line %d: invalid frame %q", lineNum, fields[0])
+		}
+		if len(events) > 0 && frame <= events[len(events)-1].frame {
+			return nil, fmt.Errorf("line %d: frames must be in increasing order", lineNum)
+		}
+		event := InputEvent{frame: frame}
+		for _, key := range fields[1:] {
+			if !event.keys.press(key) {
+				return nil, fmt.Errorf("line %d: unknown key %q", lineNum, key)
+			}
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// press sets the key with the given name as pressed, returns false if there is no such key.
+func (k *PressedKeys) press(name string) bool {
+	keys := map[string]*bool{
+		"up": &k.up, "down": &k.down, "left": &k.left, "right": &k.right,
+		"a": &k.aBtn, "b": &k.bBtn, "start": &k.startBtn, "select": &k.selectBtn,
+	}
+	key, ok := keys[strings.ToLower(name)]
+	if ok {
+		*key = true
+	}
+	return ok
+}
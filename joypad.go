@@ -4,6 +4,8 @@ const addrJoypad = 0xff00
 
 type JoyPad struct {
 	interrupts *Interrupts
+	// Super Game Boy, which receives commands through the joypad register. Nil if not in SGB mode.
+	sgb *Sgb
 	// Whether buttons and/or dpads are select (only bits 4 and 5 can be 0)
 	selection     byte
 	dpadNibble    byte
@@ -32,6 +34,15 @@ func (j *JoyPad) Get(addr uint16) (byte, bool) {
 	}
 
 	var result = j.selection
+	if j.sgb != nil && j.selection&0x30 == 0x30 {
+		if id, ok := j.sgb.JoypadId(); ok {
+			return (result & 0xf0) | id, true
+		}
+	}
+	if j.sgb != nil && !j.sgb.IsPlayer1Selected() {
+		// In SGB multiplayer mode, the other joypads have no keys pressed.
+		return result, true
+	}
 	if !isBitSet(j.selection, 4) {
 		result &= j.dpadNibble
 	}
@@ -46,6 +57,9 @@ func (j *JoyPad) Set(addr uint16, v byte) bool {
 		return false
 	}
 	j.selection = v | 0xcf // Set unused bits to 1.
+	if j.sgb != nil {
+		j.sgb.OnJoypadWrite(v)
+	}
 	return true
 }
 
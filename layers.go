@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Layer is one of the layers the LCD image is made of.
+type Layer int
+
+const (
+	LayerBackground Layer = iota
+	LayerWindow
+	LayerObjects
+)
+
+var layerNames = []string{"bg", "window", "obj"}
+
+func (l Layer) String() string {
+	return layerNames[l]
+}
+
+// ParseLayer returns the layer with the given name.
+func ParseLayer(name string) (Layer, error) {
+	for i, layerName := range layerNames {
+		if layerName == name {
+			return Layer(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown layer %q", name)
+}
+
+// Colors (RGB555) used to tint pixels by the layer they come from.
+var layerTints = map[PixelSource]uint16{
+	SourceBackground: 0x001f, // Red
+	SourceWindow:     0x03e0, // Green
+	SourceObject0:    0x7c00, // Blue
+	SourceObject1:    0x03ff, // Yellow
+}
+
+// Layers are debug settings to find graphics glitches: each layer can be hidden, and pixels can be tinted by the layer
+// they come from. They only change what is displayed, the registers seen by the game are not affected. They are
+// toggled by the UI, and read by the emulator goroutine for every pixel.
+type Layers struct {
+	hidden [3]atomic.Bool
+	tint   atomic.Bool
+}
+
+// Toggle hides or shows the layer, returns true if the layer is now hidden.
+func (l *Layers) Toggle(layer Layer) bool {
+	return toggle(&l.hidden[layer])
+}
+
+// ToggleTint enables or disables the tint, returns true if it is now enabled.
+func (l *Layers) ToggleTint() bool {
+	return toggle(&l.tint)
+}
+
+// toggle inverts the value, and returns the new value.
+func toggle(v *atomic.Bool) bool {
+	for {
+		old := v.Load()
+		if v.CompareAndSwap(old, !old) {
+			return !old
+		}
+	}
+}
+
+func (l *Layers) String() string {
+	var parts []string
+	for i := range l.hidden {
+		state := "shown"
+		if l.hidden[i].Load() {
+			state = "hidden"
+		}
+		parts = append(parts, fmt.Sprintf("%v: %s", Layer(i), state))
+	}
+	if l.tint.Load() {
+		parts = append(parts, "tint: on")
+	} else {
+		parts = append(parts, "tint: off")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// filter removes the pixels of the hidden layers: they become transparent.
+func (l *Layers) filter(bg BgEntry, obj ObjEntry) (BgEntry, ObjEntry) {
+	if (bg.window && l.hidden[LayerWindow].Load()) || (!bg.window && l.hidden[LayerBackground].Load()) {
+		bg.pixel = 0
+	}
+	if l.hidden[LayerObjects].Load() {
+		obj = ObjEntry{}
+	}
+	return bg, obj
+}
+
+// tintColor mixes a RGB555 color with the tint of the layer it comes from.
+func tintColor(color uint16, source PixelSource) uint16 {
+	tint := layerTints[source]
+	var tinted uint16
+	for shift := 0; shift < 15; shift += 5 {
+		channel := (color>>shift&0x1f + tint>>shift&0x1f) / 2
+		tinted |= channel << shift
+	}
+	return tinted
+}
+
+// shadeColor returns the grey RGB555 color of a DMG shade.
+func shadeColor(shade byte) uint16 {
+	v := uint16(3-shade) * 0x1f / 3
+	return v | v<<5 | v<<10
+}
@@ -6,36 +6,131 @@ import (
 	"os"
 )
 
+var logNoTimestamp = log.New(os.Stderr, "", 0)
+
 func main() {
-	logNoTimestamp := log.New(os.Stderr, "", 0)
+	if len(os.Args) > 1 && os.Args[1] == "dump-vram" {
+		dumpVram(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "render-audio" {
+		renderAudio(os.Args[2:])
+		return
+	}
+
 	bootRomFlag := flag.String("boot_rom", "", "the boot rom to use, optional")
 	debugFlag := flag.Bool("debug", false, "start the emulator in debugger mode")
 	traceFlag := flag.Bool("trace", false, "prints every executed instruction for debugging")
 	muteFlag := flag.Bool("mute", false, "do not play sounds")
+	ppuFlag := flag.String("ppu", "fifo", "the PPU renderer: 'fifo' (accurate) or 'fast' (scanline based)")
+	paletteFlag := flag.String("palette", "", "the colors for DMG games: grey, dmg, pocket, light, contrast or a custom palette, optional")
+	paletteFileFlag := flag.String("palette_file", "", "a file with custom palettes for DMG games, optional")
+	sgbFlag := flag.Bool("sgb", false, "emulate the Super Game Boy (colors and border) for games that support it")
+	ghostingFlag := flag.Bool("ghosting", false, "blend each frame with the previous ones, like the DMG LCD")
+	gridFlag := flag.Bool("grid", false, "draw the LCD pixel grid")
+	colorCorrectionFlag := flag.Bool("color_correction", false, "mix the colors like the CGB LCD")
+	screenshotFrameFlag := flag.Int("screenshot_at_frame", 0, "save a screenshot when this frame is drawn, then exit")
+	screenshotOutFlag := flag.String("screenshot_out", "",
+		"the PNG file for -screenshot_at_frame, named after the game by default")
+	screenshotScaleFlag := flag.Int("screenshot_scale", 1, "scale factor of the -screenshot_at_frame screenshot")
+	recordVideoFlag := flag.String("record_video", "", "record a video to this Y4M file, with audio in a WAV file next to it")
+	recordAudioFlag := flag.String("record_audio", "", "record the audio to this WAV file")
+	recordVgmFlag := flag.String("record_vgm", "", "record the writes to the sound registers to this VGM file")
+	audioStemsFlag := flag.Bool("audio_stems", false, "also record each audio channel to a separate WAV file")
+	scaleFlag := flag.String("scale", "integer", "how the screen is scaled to the window: 'integer', 'fit' or 'stretch'")
+	syncFlag := flag.String("sync", "video", "what paces the emulator: 'video' (system clock), 'audio' (audio output) or 'none'")
 	flag.Parse()
 
+	if *ppuFlag != "fifo" && *ppuFlag != "fast" {
+		logNoTimestamp.Fatal("Invalid -ppu value: ", *ppuFlag)
+	}
+
+	scaleMode, err := ParseScaleMode(*scaleFlag)
+	if err != nil {
+		logNoTimestamp.Fatal(err)
+	}
+
+	syncMode, err := ParseSyncMode(*syncFlag)
+	if err != nil {
+		logNoTimestamp.Fatal(err)
+	}
+	if syncMode == SyncAudio && *muteFlag {
+		logNoTimestamp.Fatal("-sync=audio requires the audio, it can't be used with -mute")
+	}
+
+	if *screenshotScaleFlag < 1 {
+		logNoTimestamp.Fatal("Invalid -screenshot_scale value: ", *screenshotScaleFlag)
+	}
+
 	if flag.NArg() < 1 {
 		logNoTimestamp.Fatal("A ROM file must be provided")
 	}
 
-	// Parse ROM and boot ROM (if provided)
-	rom, err := os.ReadFile(flag.Arg(0))
-	if err != nil {
-		logNoTimestamp.Fatal("Failed to load ROM: ", err)
+	rom, bootRom, gbs := loadRom(flag.Arg(0), *bootRomFlag)
+
+	// Custom palettes are added to the built-in ones.
+	palettes := dmgPalettes
+	if len(*paletteFileFlag) > 0 {
+		customPalettes, err := LoadPalettes(*paletteFileFlag)
+		if err != nil {
+			logNoTimestamp.Fatal("Failed to load palettes: ", err)
+		}
+		palettes = append(customPalettes, palettes...)
 	}
-	var bootRom []byte
-	if len(*bootRomFlag) > 0 {
-		var err error
-		bootRom, err = os.ReadFile(*bootRomFlag)
+	paletteIndex := 0
+	if len(*paletteFlag) > 0 {
+		paletteIndex, err = FindPalette(palettes, *paletteFlag)
 		if err != nil {
-			logNoTimestamp.Fatal("Failed to load boot ROM: ", err)
+			logNoTimestamp.Fatal(err)
 		}
 	}
 
 	// Init game engine and emulator
-	game := MakeGame()
-	emulator := MakeEmulator(bootRom, rom, *debugFlag, *traceFlag, game)
+	displayOptions := DisplayOptions{
+		ghosting:        *ghostingFlag,
+		grid:            *gridFlag,
+		colorCorrection: *colorCorrectionFlag,
+		scaleMode:       scaleMode,
+	}
+	game := MakeGame(displayOptions)
+	game.SetPalettes(palettes, paletteIndex)
+	if gbs != nil {
+		game.SetRomTitle(gbs.title)
+	} else {
+		game.SetRomTitle(RomTitle(rom))
+	}
+	game.SetAudioStems(*audioStemsFlag)
+	if len(*recordAudioFlag) > 0 {
+		game.ToggleAudioRecording(*recordAudioFlag)
+	}
+	if len(*recordVideoFlag) > 0 {
+		game.ToggleVideoRecording(*recordVideoFlag)
+	}
+	if len(*recordVgmFlag) > 0 {
+		if gbs != nil {
+			game.StartVgmRecording(*recordVgmFlag, gbs.VgmTags())
+		} else {
+			game.StartVgmRecording(*recordVgmFlag, RomVgmTags(rom))
+		}
+	}
+	if *screenshotFrameFlag > 0 {
+		game.SetScreenshotAtFrame(*screenshotFrameFlag, *screenshotOutFlag, *screenshotScaleFlag)
+	}
+	options := EmulatorOptions{debug: *debugFlag, trace: *traceFlag, fastPpu: *ppuFlag == "fast", sgb: *sgbFlag,
+		sync: syncMode}
+	emulator := MakeEmulator(bootRom, rom, options, game)
+	// The game records the audio and the APU writes.
+	emulator.SetSampleListener(game)
+	emulator.SetApuWriteListener(game)
+	emulator.SetDebuggerPalette(game.Palette)
 	game.SetKeysListener(emulator.joypad)
+	if gbs != nil {
+		game.SetTrackPlayer(MakeGbsPlayer(gbs, &emulator))
+	}
+	game.SetLayers(&emulator.ppuMemory.layers)
+	game.SetChannelMutes(&emulator.apu.mutes)
+	game.SetVramViewer(MakeVramViewer(emulator.mcu, emulator.ppuMemory))
+	game.SetOscilloscope(MakeOscilloscope(emulator.apu))
 	if !*muteFlag {
 		game.SetAudioStream(emulator.apu)
 	}
@@ -44,3 +139,88 @@ func main() {
 	go emulator.Run()
 	game.Run()
 }
+
+// dumpVram runs a game without display for some frames, then saves VRAM to PNG files.
+// Usage: goodboy dump-vram [-frames N] [-out dir] [-palette name] <rom file>
+func dumpVram(args []string) {
+	flags := flag.NewFlagSet("dump-vram", flag.ExitOnError)
+	framesFlag := flags.Int("frames", 600, "the number of frames to run before dumping VRAM")
+	outFlag := flags.String("out", ".", "the directory where the PNG files are saved")
+	paletteFlag := flags.String("palette", "grey", "the colors for DMG games")
+	bootRomFlag := flags.String("boot_rom", "", "the boot rom to use, optional")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		logNoTimestamp.Fatal("A ROM file must be provided")
+	}
+	rom, bootRom, _ := loadRom(flags.Arg(0), *bootRomFlag)
+	paletteIndex, err := FindPalette(dmgPalettes, *paletteFlag)
+	if err != nil {
+		logNoTimestamp.Fatal(err)
+	}
+
+	paths, err := DumpVramAfter(bootRom, rom, *framesFlag, &dmgPalettes[paletteIndex], *outFlag)
+	for _, path := range paths {
+		logNoTimestamp.Print("Saved ", path)
+	}
+	if err != nil {
+		logNoTimestamp.Fatal("Failed to dump VRAM: ", err)
+	}
+}
+
+// renderAudio runs a game without display for some frames, with scripted inputs, and saves the audio to a WAV file.
+// Usage: goodboy render-audio -rom <rom file> [-frames N] [-input script] <wav file>
+func renderAudio(args []string) {
+	flags := flag.NewFlagSet("render-audio", flag.ExitOnError)
+	romFlag := flags.String("rom", "", "the ROM or GBS file to run")
+	framesFlag := flags.Int("frames", 3600, "the number of frames to run")
+	inputFlag := flags.String("input", "", "a file with the keys to press at given frames, optional")
+	bootRomFlag := flags.String("boot_rom", "", "the boot rom to use, optional")
+	flags.Parse(args)
+
+	if len(*romFlag) == 0 {
+		logNoTimestamp.Fatal("A ROM file must be provided with -rom")
+	}
+	if flags.NArg() < 1 {
+		logNoTimestamp.Fatal("An output WAV file must be provided")
+	}
+	rom, bootRom, gbs := loadRom(*romFlag, *bootRomFlag)
+	var events []InputEvent
+	if len(*inputFlag) > 0 {
+		var err error
+		events, err = LoadInputScript(*inputFlag)
+		if err != nil {
+			logNoTimestamp.Fatal("Failed to load input script: ", err)
+		}
+	}
+
+	if err := RenderAudio(bootRom, rom, gbs, *framesFlag, events, flags.Arg(0)); err != nil {
+		logNoTimestamp.Fatal("Failed to render audio: ", err)
+	}
+	logNoTimestamp.Print("Saved ", flags.Arg(0))
+}
+
+// loadRom reads the ROM and the boot ROM, if a path is given. A GBS file is returned too, with a cartridge built for
+// it as ROM, and no boot ROM.
+func loadRom(romPath string, bootRomPath string) ([]byte, []byte, *GbsFile) {
+	rom, err := os.ReadFile(romPath)
+	if err != nil {
+		logNoTimestamp.Fatal("Failed to load ROM: ", err)
+	}
+	if IsGbsFile(rom) {
+		gbs, err := ParseGbs(rom)
+		if err != nil {
+			logNoTimestamp.Fatal("Failed to load GBS file: ", err)
+		}
+		return gbs.Rom(), nil, gbs
+	}
+
+	var bootRom []byte
+	if len(bootRomPath) > 0 {
+		bootRom, err = os.ReadFile(bootRomPath)
+		if err != nil {
+			logNoTimestamp.Fatal("Failed to load boot ROM: ", err)
+		}
+	}
+	return rom, bootRom, nil
+}
@@ -11,18 +11,29 @@ const (
 	addrUnusableEnd = 0xff00
 	addrIoEnd       = 0xff80
 	addrUseBootRom  = 0xff50
+	addrVramBank    = 0xff4f
+	addrWramBank    = 0xff70
 	openValue       = 0xff
+
+	dmgBootRomSize = 0x100
+	// The CGB boot ROM is mapped at 0-0x100 and 0x200-0x900, the cartridge header is visible in-between.
+	cgbBootRomSize = 0x900
 )
 
 // Mcu (Memory Control Unit) of the system.
 type Mcu struct {
-	bootRom        []byte // Boot ROM internal to the device, 256 bytes
+	bootRom        []byte // Boot ROM internal to the device, 256 bytes (2304 for CGB)
 	bootRomEnabled bool   // If true, access to addresses 0-0x100 goes to the cartridge
 
-	vram [8 * 1024]byte // Video RAM
-	wram [8 * 1024]byte // Work RAM
-	oam  [160]byte      // Object Attribute Memory, where sprite attributes are stored
-	hram [127]byte      // High ram
+	vram [2][8 * 1024]byte // Video RAM. The second bank is only available on CGB.
+	wram [8][4 * 1024]byte // Work RAM. The first bank is fixed, banks 2-7 are only available on CGB.
+	oam  [160]byte         // Object Attribute Memory, where sprite attributes are stored
+	hram [127]byte         // High ram
+
+	// CGB mode: VRAM and WRAM banks can be switched with VBK and SVBK.
+	cgb      bool
+	vramBank int
+	wramBank int
 
 	cartridge  *Cartridge
 	ioHandlers []IoHandler
@@ -39,14 +50,14 @@ type IoHandler interface {
 	Set(addr uint16, value byte) bool
 }
 
-func CreateMemory(ioHandlers []IoHandler) Mcu {
-	mcu := Mcu{ioHandlers: ioHandlers}
+func CreateMemory(ioHandlers []IoHandler, cgb bool) Mcu {
+	mcu := Mcu{ioHandlers: ioHandlers, cgb: cgb, wramBank: 1}
 	mcu.bootRomEnabled = false // Default to no boot rom
 	return mcu
 }
 
 func (mcu *Mcu) SetBootRom(rom []byte) {
-	if len(rom) != addrBootRomEnd {
+	if len(rom) != dmgBootRomSize && len(rom) != cgbBootRomSize {
 		panic("Rom is wrong size")
 	}
 	mcu.bootRom = rom
@@ -64,22 +75,26 @@ func (mcu *Mcu) GetWord(address uint16) uint16 {
 
 func (mcu *Mcu) Get(address uint16) byte {
 	switch {
-	case address < addrBootRomEnd && mcu.bootRomEnabled:
+	case mcu.isBootRomAddress(address):
 		return mcu.bootRom[address]
 	case address < addrRomEnd:
 		return mcu.cartridge.Read(address)
 	case address < addrVideoRamEnd:
-		return mcu.vram[address-addrRomEnd]
+		return mcu.vram[mcu.vramBank][address-addrRomEnd]
 	case address < addrCartRamEnd:
 		return mcu.cartridge.Read(address)
 	case address < addrWorkRamEnd:
-		return mcu.wram[address-addrCartRamEnd]
+		return *mcu.wramByte(address - addrCartRamEnd)
 	case address < addrEchoRamEnd:
-		return mcu.wram[address-addrWorkRamEnd]
+		return *mcu.wramByte(address - addrWorkRamEnd)
 	case address < addrOamEnd:
 		return mcu.oam[address-addrEchoRamEnd]
 	case address < addrUnusableEnd:
 		return openValue // Not usable, return open value
+	case address == addrVramBank && mcu.cgb:
+		return byte(mcu.vramBank) | 0xfe
+	case address == addrWramBank && mcu.cgb:
+		return byte(mcu.wramBank) | 0xf8
 	case address < addrIoEnd || address == addrInterruptEnable:
 		for _, handler := range mcu.ioHandlers {
 			if value, handled := handler.Get(address); handled {
@@ -96,22 +111,27 @@ func (mcu *Mcu) Get(address uint16) byte {
 
 func (mcu *Mcu) Set(address uint16, value byte) {
 	switch {
-	case address < addrBootRomEnd && mcu.bootRomEnabled:
+	case mcu.isBootRomAddress(address):
 		// Do nothing, can't write to boot rom
 	case address < addrRomEnd:
 		mcu.cartridge.Write(address, value)
 	case address < addrVideoRamEnd:
-		mcu.vram[address-addrRomEnd] = value
+		mcu.vram[mcu.vramBank][address-addrRomEnd] = value
 	case address < addrCartRamEnd:
 		mcu.cartridge.Write(address, value)
 	case address < addrWorkRamEnd:
-		mcu.wram[address-addrCartRamEnd] = value
+		*mcu.wramByte(address - addrCartRamEnd) = value
 	case address < addrEchoRamEnd:
-		mcu.wram[address-addrWorkRamEnd] = value
+		*mcu.wramByte(address - addrWorkRamEnd) = value
 	case address < addrOamEnd:
 		mcu.oam[address-addrEchoRamEnd] = value
 	case address < addrUnusableEnd:
 		// Do nothing, unusable area
+	case address == addrVramBank && mcu.cgb:
+		mcu.vramBank = int(value & 0x1)
+	case address == addrWramBank && mcu.cgb:
+		// Bank 0 can't be selected in the upper half, selects bank 1 instead.
+		mcu.wramBank = max(1, int(value&0x7))
 	case address < addrIoEnd || address == addrInterruptEnable:
 		if address == addrUseBootRom && value != 0 {
 			mcu.bootRomEnabled = false
@@ -134,3 +154,20 @@ func (mcu *Mcu) SetWord(address uint16, value uint16) {
 	mcu.Set(address+1, hi)
 	mcu.Set(address, lo)
 }
+
+func (mcu *Mcu) isBootRomAddress(address uint16) bool {
+	if !mcu.bootRomEnabled {
+		return false
+	}
+	return address < addrBootRomEnd ||
+		(len(mcu.bootRom) == cgbBootRomSize && address >= 0x200 && address < cgbBootRomSize)
+}
+
+// wramByte returns the work RAM byte at the given offset from the start of the work RAM, in the selected bank.
+func (mcu *Mcu) wramByte(offset uint16) *byte {
+	const bankSize = uint16(len(mcu.wram[0]))
+	if offset < bankSize {
+		return &mcu.wram[0][offset]
+	}
+	return &mcu.wram[mcu.wramBank][offset-bankSize]
+}
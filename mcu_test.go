@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestWramBank(t *testing.T) {
+	tests := []struct {
+		svbk     byte
+		wantBank int
+	}{
+		{0, 1}, // Bank 0 can't be selected in the upper half.
+		{1, 1},
+		{2, 2},
+		{7, 7},
+		{0xfa, 2}, // Only the lower 3 bits are used.
+	}
+	for _, tt := range tests {
+		mcu := CreateMemory(nil, true)
+		for bank := range mcu.wram {
+			mcu.wram[bank][0] = byte(bank)
+		}
+		mcu.Set(addrWramBank, tt.svbk)
+		if got := mcu.Get(0xd000); got != byte(tt.wantBank) {
+			t.Errorf("SVBK=0x%02x: 0xd000 reads bank %d, want %d", tt.svbk, got, tt.wantBank)
+		}
+		if got := mcu.Get(0xc000); got != 0 {
+			t.Errorf("SVBK=0x%02x: 0xc000 reads bank %d, want 0", tt.svbk, got)
+		}
+	}
+}
+
+func TestVramBank(t *testing.T) {
+	mcu := CreateMemory(nil, true)
+	mcu.Set(addrVramBank, 0)
+	mcu.Set(0x8123, 0xaa)
+	mcu.Set(addrVramBank, 1)
+	if got := mcu.Get(0x8123); got != 0 {
+		t.Errorf("Bank 1 reads 0x%02x, want the value written to bank 0 not to be visible", got)
+	}
+	mcu.Set(0x8123, 0xbb)
+	if got := mcu.Get(addrVramBank); got != 0xff {
+		t.Errorf("VBK reads 0x%02x, want 0xff", got)
+	}
+	mcu.Set(addrVramBank, 0xfe) // Only bit 0 is used.
+	if got := mcu.Get(0x8123); got != 0xaa {
+		t.Errorf("Bank 0 reads 0x%02x, want 0xaa", got)
+	}
+	if mcu.vram[0][0x123] != 0xaa || mcu.vram[1][0x123] != 0xbb {
+		t.Errorf("VRAM banks have 0x%02x and 0x%02x, want 0xaa and 0xbb", mcu.vram[0][0x123], mcu.vram[1][0x123])
+	}
+}
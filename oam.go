@@ -15,6 +15,11 @@ type Sprite struct {
 	xFlip, yFlip bool
 	// If true use palette 0, otherwise palette 1
 	palette0 bool
+	// CGB only: the color palette (0-7) and the VRAM bank of the tile.
+	cgbPalette byte
+	vramBank   byte
+	// Position in OAM. On CGB, sprites with a lower id are drawn on top.
+	id byte
 }
 
 func LoadSprite(mcu *Mcu, id byte) Sprite {
@@ -31,6 +36,9 @@ func LoadSprite(mcu *Mcu, id byte) Sprite {
 		xFlip:      isBitSet(flags, 5),
 		yFlip:      isBitSet(flags, 6),
 		palette0:   !isBitSet(flags, 4),
+		cgbPalette: flags & 0x7,
+		vramBank:   (flags >> 3) & 0x1,
+		id:         id,
 	}
 }
 
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
+)
+
+const (
+	// Samples kept for each channel, more than shown so that the waveform can start at a rising edge.
+	scopeSamples = 2048
+	scopeWidth   = 512
+	scopeHeight  = 64
+)
+
+var (
+	channelNames = []string{"Pulse 1", "Pulse 2", "Wave", "Noise"}
+	scopeColors  = []color.RGBA{
+		{0xff, 0x60, 0x60, 0xff}, {0xff, 0xc0, 0x40, 0xff}, {0x60, 0xe0, 0x60, 0xff}, {0x60, 0xa0, 0xff, 0xff},
+	}
+	scopeBgColor  = color.RGBA{0x10, 0x10, 0x10, 0xff}
+	scopeMidColor = color.RGBA{0x40, 0x40, 0x40, 0xff}
+	noteNames     = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+	dutyCycles    = []string{"12.5%", "25%", "50%", "75%"}
+	waveVolumes   = []string{"0%", "100%", "50%", "25%"}
+)
+
+// Oscilloscope keeps the last output of each APU channel, to show the waveforms with what each channel is playing.
+type Oscilloscope struct {
+	apu *Apu
+	// Ring buffer of the samples of each channel, and the state of the channels at the last sample. They are added
+	// from the emulator goroutine.
+	samples  [4][scopeSamples]float32
+	pos      int
+	channels channelsState
+	mu       sync.Mutex
+}
+
+// channelsState is a copy of the APU registers that describe what the channels are playing.
+type channelsState struct {
+	on         [4]bool
+	volume     [4]byte
+	period     [3]uint16
+	dutyCycles [2]byte
+	randomness byte
+}
+
+func MakeOscilloscope(apu *Apu) *Oscilloscope {
+	return &Oscilloscope{apu: apu}
+}
+
+// AddSample adds the output of each channel, and saves the state of the channels. It must be called from the goroutine
+// that runs the APU.
+func (o *Oscilloscope) AddSample(sample AudioSample) {
+	a := o.apu
+	o.mu.Lock()
+	for chNum, s := range sample.channels {
+		o.samples[chNum][o.pos] = s
+	}
+	o.pos = (o.pos + 1) % scopeSamples
+	o.channels = channelsState{
+		on:         a.channelsOn,
+		volume:     a.volume,
+		period:     a.period,
+		dutyCycles: [2]byte{a.ch1DutyCycle, a.ch2DutyCycle},
+		randomness: a.ch4Randomness,
+	}
+	o.mu.Unlock()
+}
+
+// WaveformsImage returns the waveforms of the 4 channels, one below the other. Each starts at a rising edge, if
+// there is one, so that periodic waves are stable from one frame to the next.
+func (o *Oscilloscope) WaveformsImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, scopeWidth, 4*(scopeHeight+viewerCellSpace)-viewerCellSpace))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for chNum := range o.samples {
+		top := chNum * (scopeHeight + viewerCellSpace)
+		rect := image.Rect(0, top, scopeWidth, top+scopeHeight)
+		draw.Draw(img, rect, image.NewUniform(scopeBgColor), image.Point{}, draw.Src)
+		for x := 0; x < scopeWidth; x++ {
+			img.SetRGBA(x, top+scopeHeight/2, scopeMidColor)
+		}
+
+		start := o.triggerPosition(chNum)
+		prevY := -1
+		for x := 0; x < scopeWidth; x++ {
+			s := o.samples[chNum][(start+x)%scopeSamples]
+			y := top + scopeHeight - 1 - int(max(0, min(1, s))*(scopeHeight-1))
+			if prevY < 0 {
+				prevY = y
+			}
+			// Join the points with vertical lines, for the edges of square waves.
+			for lineY := min(y, prevY); lineY <= max(y, prevY); lineY++ {
+				img.SetRGBA(x, lineY, scopeColors[chNum])
+			}
+			prevY = y
+		}
+	}
+	return img
+}
+
+// triggerPosition returns where the waveform of a channel should start: the latest rising edge that leaves enough
+// samples to fill the width, or the oldest of these samples if there is no edge.
+func (o *Oscilloscope) triggerPosition(chNum int) int {
+	samples := &o.samples[chNum]
+	// Oldest and newest positions where the waveform can start.
+	oldest := o.pos
+	newest := (o.pos + scopeSamples - scopeWidth) % scopeSamples
+	low, high := float32(math.Inf(1)), float32(math.Inf(-1))
+	for _, s := range samples {
+		low, high = min(low, s), max(high, s)
+	}
+	mid := (low + high) / 2
+	for i := 0; i < scopeSamples-scopeWidth; i++ {
+		pos := (newest - i + scopeSamples) % scopeSamples
+		prev := (pos + scopeSamples - 1) % scopeSamples
+		if pos != oldest && samples[prev] < mid && samples[pos] >= mid {
+			return pos
+		}
+	}
+	return oldest
+}
+
+// ChannelsInfo returns a few lines describing what each channel is playing: frequency, note, volume and duty cycle.
+func (o *Oscilloscope) ChannelsInfo() [4][]string {
+	o.mu.Lock()
+	channels := o.channels
+	o.mu.Unlock()
+
+	var info [4][]string
+	for chNum := range info {
+		status := "off"
+		if channels.on[chNum] {
+			status = "on"
+		}
+		if !o.apu.mutes.isAudible(chNum) {
+			status += ", muted"
+		}
+		lines := []string{fmt.Sprintf("CH%d %s (%s)", chNum+1, channelNames[chNum], status)}
+
+		frequency := channels.frequency(chNum)
+		if chNum == 3 {
+			lines = append(lines, fmt.Sprintf("%.0f Hz", frequency))
+		} else {
+			lines = append(lines, fmt.Sprintf("%.1f Hz %s", frequency, noteName(frequency)))
+		}
+
+		switch chNum {
+		case 0, 1:
+			lines = append(lines, fmt.Sprintf("Vol %d Duty %s", channels.volume[chNum],
+				dutyCycles[channels.dutyCycles[chNum]]))
+		case 2:
+			lines = append(lines, fmt.Sprintf("Vol %s", waveVolumes[channels.volume[2]&0x3]))
+		case 3:
+			width := "15 bit"
+			if isBitSet(channels.randomness, 3) {
+				width = "7 bit"
+			}
+			lines = append(lines, fmt.Sprintf("Vol %d LFSR %s", channels.volume[3], width))
+		}
+		info[chNum] = lines
+	}
+	return info
+}
+
+// frequency returns the frequency of the wave played by a channel, or the rate at which the noise changes.
+func (s *channelsState) frequency(chNum int) float64 {
+	switch chNum {
+	case 3:
+		// The LFSR shifts at 262144 / (divisor * 2^shift) Hz, where a divisor of 0 counts as 0.5.
+		divisor := float64(s.randomness & 0x7)
+		if divisor == 0 {
+			divisor = 0.5
+		}
+		return 262144 / divisor / float64(int(1)<<(s.randomness>>4))
+	case 2:
+		// A whole wave is 32 samples, at 2Mhz.
+		return clockFreq * 2 / 32 / float64(maxPeriod+1-s.period[2])
+	default:
+		// A whole wave is 8 samples, at 1Mhz.
+		return clockFreq / 8 / float64(maxPeriod+1-s.period[chNum])
+	}
+}
+
+// noteName returns the closest note to a frequency, with the difference in cents.
+func noteName(frequency float64) string {
+	// MIDI note numbers: A4 (440 Hz) is 69, C4 is 60.
+	note := 69 + 12*math.Log2(frequency/440)
+	closest := math.Round(note)
+	cents := int(math.Round((note - closest) * 100))
+	n := int(closest)
+	return fmt.Sprintf("%s%d %+dc", noteNames[(n%12+12)%12], n/12-1, cents)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PaletteColors are the RGB colors of the 4 DMG shades, from lightest to darkest.
+type PaletteColors [4][3]byte
+
+// DmgPalette maps the DMG shades to colors. The background and the window share the same colors, sprites can have
+// different colors depending on the palette register they use.
+type DmgPalette struct {
+	name string
+	bg   PaletteColors
+	obj0 PaletteColors
+	obj1 PaletteColors
+}
+
+func makeDmgPalette(name string, colors PaletteColors) DmgPalette {
+	return DmgPalette{name: name, bg: colors, obj0: colors, obj1: colors}
+}
+
+// Built-in palettes. The first one is the default.
+var dmgPalettes = []DmgPalette{
+	makeDmgPalette("grey", PaletteColors{{255, 255, 255}, {165, 165, 165}, {82, 82, 82}, {0, 0, 0}}),
+	makeDmgPalette("dmg", PaletteColors{{155, 188, 15}, {139, 172, 15}, {48, 98, 48}, {15, 56, 15}}),
+	makeDmgPalette("pocket", PaletteColors{{196, 207, 161}, {139, 149, 109}, {77, 83, 60}, {31, 31, 31}}),
+	makeDmgPalette("light", PaletteColors{{0, 178, 132}, {0, 156, 116}, {0, 104, 74}, {0, 81, 56}}),
+	makeDmgPalette("contrast", PaletteColors{{255, 255, 255}, {255, 255, 0}, {255, 0, 0}, {0, 0, 0}}),
+}
+
+// colors returns the colors to use for a pixel coming from the given source.
+func (p *DmgPalette) colors(source PixelSource) *PaletteColors {
+	switch source {
+	case SourceObject0:
+		return &p.obj0
+	case SourceObject1:
+		return &p.obj1
+	default:
+		return &p.bg
+	}
+}
+
+// FindPalette returns the index of the palette with the given name in palettes.
+func FindPalette(palettes []DmgPalette, name string) (int, error) {
+	for i, palette := range palettes {
+		if palette.name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown palette %q", name)
+}
+
+// LoadPalettes reads palettes from a text file. Each palette starts with a "name" line, followed by the 4 colors (hex
+// RGB, lightest first) of the background and, optionally, of the two sprite palettes, which otherwise use the
+// background colors. Empty lines and lines starting with # are ignored. For example:
+//
+//	name autumn
+//	bg   fff6d3 f9a875 eb6b6f 7c3f58
+//	obj0 fff6d3 eb6b6f 7c3f58 000000
+//	obj1 fff6d3 f9a875 7c3f58 000000
+func LoadPalettes(path string) ([]DmgPalette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var palettes []DmgPalette
+	var hasObj0, hasObj1 bool
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "name" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected 'name <name>'", lineNum)
+			}
+			palettes = append(palettes, DmgPalette{name: fields[1]})
+			hasObj0, hasObj1 = false, false
+			continue
+		}
+		if len(palettes) == 0 {
+			return nil, fmt.Errorf("line %d: palette name missing", lineNum)
+		}
+
+		colors, err := parsePaletteColors(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		palette := &palettes[len(palettes)-1]
+		switch fields[0] {
+		case "bg":
+			palette.bg = colors
+			if !hasObj0 {
+				palette.obj0 = colors
+			}
+			if !hasObj1 {
+				palette.obj1 = colors
+			}
+		case "obj0":
+			palette.obj0 = colors
+			hasObj0 = true
+		case "obj1":
+			palette.obj1 = colors
+			hasObj1 = true
+		default:
+			return nil, fmt.Errorf("line %d: unknown layer %q", lineNum, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(palettes) == 0 {
+		return nil, fmt.Errorf("no palettes found in %s", path)
+	}
+	return palettes, nil
+}
+
+func parsePaletteColors(fields []string) (PaletteColors, error) {
+	var colors PaletteColors
+	if len(fields) != len(colors) {
+		return colors, fmt.Errorf("expected %d colors, got %d", len(colors), len(fields))
+	}
+	for i, field := range fields {
+		rgb, err := hex.DecodeString(strings.TrimPrefix(field, "#"))
+		if err != nil || len(rgb) != 3 {
+			return colors, fmt.Errorf("invalid color %q", field)
+		}
+		copy(colors[i][:], rgb)
+	}
+	return colors, nil
+}
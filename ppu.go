@@ -24,6 +24,18 @@ const (
 	Rendering         = 3
 )
 
+// LineRenderer draws the pixels of a line while the PPU is in the Rendering mode.
+type LineRenderer interface {
+	// SetRow starts rendering a new row, with the given sprites found during OAM scan.
+	SetRow(row byte, sprites []Sprite)
+	// Tick advances the renderer by a dot.
+	Tick()
+	// IsDone returns true when the row has been rendered.
+	IsDone() bool
+	// Clear resets the renderer at the end of a frame.
+	Clear()
+}
+
 // Ppu or Pixel Processing Unit of the system.
 // Processes pixels into 3 modes:
 // - OAM Scan: finds sprites for the current line
@@ -33,14 +45,26 @@ type Ppu struct {
 	interrupts     *Interrupts
 	mcu            *Mcu
 	mem            *PpuMemory
-	renderer       *PpuRenderer
+	renderer       LineRenderer
+	vramDma        *VramDma
+	frameListener  FrameListener
 	sprites        []Sprite
 	mode           PpuMode
 	currentLineDot int
 }
 
-func MakePpu(mainMem *Mcu, mem *PpuMemory, interrupts *Interrupts, pixelSetter PixelSetter) Ppu {
-	return Ppu{mcu: mainMem, mem: mem, interrupts: interrupts, mode: 2, renderer: MakePpuRenderer(mainMem, mem, pixelSetter)}
+// MakePpu creates a new PPU. If fastRenderer is true, lines are drawn with ScanlineRenderer instead of PpuRenderer.
+// frameListener can be nil.
+func MakePpu(mainMem *Mcu, mem *PpuMemory, interrupts *Interrupts, vramDma *VramDma, pixelSetter PixelSetter,
+	frameListener FrameListener, fastRenderer bool) Ppu {
+	var renderer LineRenderer
+	if fastRenderer {
+		renderer = MakeScanlineRenderer(mainMem, mem, pixelSetter)
+	} else {
+		renderer = MakePpuRenderer(mainMem, mem, pixelSetter)
+	}
+	return Ppu{mcu: mainMem, mem: mem, interrupts: interrupts, vramDma: vramDma, frameListener: frameListener, mode: 2,
+		renderer: renderer}
 }
 
 func (ppu *Ppu) Tick() {
@@ -126,6 +150,7 @@ func (ppu *Ppu) switchMode(mode PpuMode) {
 		if ppu.mem.statMode0Selected() {
 			ppu.interrupts.RequestInterruptStat()
 		}
+		ppu.vramDma.OnHBlank()
 	case VBlank:
 		ppu.interrupts.RequestInterruptVBlank()
 		if ppu.mem.statMode1Selected() {
@@ -149,6 +174,9 @@ func (ppu *Ppu) nextLine() {
 		// Done with all the on-screen pixel, onto v-blank
 		ppu.renderer.Clear()
 		ppu.switchMode(VBlank)
+		if ppu.frameListener != nil {
+			ppu.frameListener.OnFrame()
+		}
 	}
 
 	// Check if current line matches requested line
@@ -21,16 +21,28 @@ type PpuFetcher struct {
 	mem         *PpuMemory
 	fetcherType FetcherType
 	sprite      *Sprite
-	row         int
-	col         int
+	// For background, row is the LCD line and col the on-screen position of the tile: the scroll registers are applied
+	// when the tile is fetched. For window, they are the position within the window.
+	row int
+	col int
 	// Where to look for in memory for tile map and tile data
-	tileDataStart []uint16
+	tileDataStart [2]uint16
 	tileMapStart  uint16
 	// Row position within a tile
 	tileRow int
 	tileId  byte
+	// CGB only: attributes of the background/window tile, see the tileAttr* constants.
+	tileAttrs byte
 }
 
+// Bits of the background/window tile attributes stored in the second VRAM bank (CGB only).
+const (
+	tileAttrBank     = 3
+	tileAttrXFlip    = 5
+	tileAttrYFlip    = 6
+	tileAttrPriority = 7
+)
+
 func CreateFetcher(mcu *Mcu, mem *PpuMemory, fetcherType FetcherType) PpuFetcher {
 	p := PpuFetcher{mcu: mcu, mem: mem, fetcherType: fetcherType}
 	p.updateAddresses()
@@ -45,11 +57,12 @@ func (p *PpuFetcher) SetFetcherType(fetcherType FetcherType) {
 func (p *PpuFetcher) SetRow(row int) {
 	p.row = row
 	p.col = 0
-	p.tileRow = p.row % 8 // Only for background. For sprites, overwritten in SetSprite.
 }
 
 // GetNextPixels returns the next 8 pixels of the current row.
 func (p *PpuFetcher) GetNextPixels() [8]byte {
+	// LCDC is read when the tile is fetched, so that changes in the middle of a line are reflected.
+	p.updateAddresses()
 	if p.sprite == nil {
 		p.tileId = p.getTileId()
 	}
@@ -59,6 +72,8 @@ func (p *PpuFetcher) GetNextPixels() [8]byte {
 	var xFlipped = false
 	if p.sprite != nil && p.sprite.xFlip {
 		xFlipped = true
+	} else if p.sprite == nil && isBitSet(p.tileAttrs, tileAttrXFlip) {
+		xFlipped = true
 	}
 	var columnMask byte = 128
 
@@ -93,25 +108,32 @@ func (p *PpuFetcher) SetSprite(sprite *Sprite) {
 	}
 
 	p.sprite = sprite
-	if p.mem.lcdObjHeight() == 8 {
-		p.tileId = sprite.tileNum
+	p.tileId, p.tileRow = spriteTile(p.mem, sprite, p.row)
+}
+
+// spriteTile returns the tile and the row within that tile to draw the given LCD row of a sprite.
+func spriteTile(mem *PpuMemory, sprite *Sprite, row int) (byte, int) {
+	var tileId byte
+	if mem.lcdObjHeight() == 8 {
+		tileId = sprite.tileNum
 	} else {
 		// With 8x16 tiles, the tileNum refers to the top tile and the bottom one is immediately after (reverse if flipped).
 		// Additionally, the bit 0 in the tile number is ignored.
 		topTile := sprite.tileNum & 0xfe
 		bottomTile := topTile + 1
-		isBottomRow := p.row+16 > int(p.sprite.y+8)
+		isBottomRow := row+16 > int(sprite.y+8)
 		if isBottomRow != sprite.yFlip {
-			p.tileId = bottomTile
+			tileId = bottomTile
 		} else {
-			p.tileId = topTile
+			tileId = topTile
 		}
 	}
 
-	p.tileRow = (p.row + 16 - int(sprite.y)) % 8 // % 8 to account for 8x16 tiles
-	if p.sprite.yFlip && p.mem.lcdObjHeight() == 8 {
-		p.tileRow = 7 - p.tileRow
+	tileRow := (row + 16 - int(sprite.y)) % 8 // % 8 to account for 8x16 tiles
+	if sprite.yFlip && mem.lcdObjHeight() == 8 {
+		tileRow = 7 - tileRow
 	}
+	return tileId, tileRow
 }
 
 // getTileId returns the id of the tile to draw the current row/column.
@@ -120,8 +142,24 @@ func (p *PpuFetcher) getTileId() byte {
 		panic("getTileId can not be called on Object fetcher")
 	}
 
-	tileIndex := ((p.row / 8) * 32) + (p.col / 8) // Tile map is 32x32 and each tile is 8x8
-	tileId := p.mcu.Get(p.tileMapStart + uint16(tileIndex))
+	mapRow, mapCol := p.row, p.col
+	if p.fetcherType == Background {
+		// Like the hardware, read SCX/SCY at every fetch. The fine scroll (SCX % 8) is handled by the renderer.
+		mapRow = (p.row + int(p.mem.lcdScrollY)) % 256
+		mapCol = (p.col + int(p.mem.lcdScrollX)/8*8) % 256
+	}
+	p.tileRow = mapRow % 8
+	tileIndex := ((mapRow / 8) * 32) + (mapCol / 8) // Tile map is 32x32 and each tile is 8x8
+	mapOffset := p.tileMapStart + uint16(tileIndex) - addrRomEnd
+	tileId := p.mcu.vram[0][mapOffset]
+
+	if p.mem.cgb {
+		// The attributes are at the same position of the tile id, in the second bank.
+		p.tileAttrs = p.mcu.vram[1][mapOffset]
+		if isBitSet(p.tileAttrs, tileAttrYFlip) {
+			p.tileRow = 7 - p.tileRow
+		}
+	}
 	return tileId
 }
 
@@ -134,16 +172,23 @@ func (p *PpuFetcher) getTileData() (byte, byte) {
 
 	tileBlockStart := p.tileDataStart[p.tileId/128]
 	tileBlockOffset := 16 * uint16(p.tileId%128)
-	tileStart := tileBlockStart + tileBlockOffset
-	return p.mcu.Get(tileStart + index), p.mcu.Get(tileStart + index + 1)
+	tileStart := tileBlockStart + tileBlockOffset - addrRomEnd
+
+	bank := 0
+	if p.mem.cgb && p.sprite != nil {
+		bank = int(p.sprite.vramBank)
+	} else if p.mem.cgb && isBitSet(p.tileAttrs, tileAttrBank) {
+		bank = 1
+	}
+	return p.mcu.vram[bank][tileStart+index], p.mcu.vram[bank][tileStart+index+1]
 }
 
 func (p *PpuFetcher) updateAddresses() {
 	// Update tile data address
 	if p.fetcherType == Object || p.mem.lcdBgWndTiles() {
-		p.tileDataStart = []uint16{tileBlocks[0], tileBlocks[1]}
+		p.tileDataStart = [2]uint16{tileBlocks[0], tileBlocks[1]}
 	} else {
-		p.tileDataStart = []uint16{tileBlocks[2], tileBlocks[1]}
+		p.tileDataStart = [2]uint16{tileBlocks[2], tileBlocks[1]}
 	}
 
 	// ...and tile map address
@@ -13,6 +13,10 @@ const (
 	addrObjPalette1 = 0xff49
 	addrWindowY     = 0xff4a
 	addrWindowX     = 0xff4b
+	addrBgPalIndex  = 0xff68
+	addrBgPalData   = 0xff69
+	addrObjPalIndex = 0xff6a
+	addrObjPalData  = 0xff6b
 )
 
 type PpuMemory struct {
@@ -28,6 +32,25 @@ type PpuMemory struct {
 	dmaAddr     byte
 	windowX     byte
 	windowY     byte
+
+	// CGB only: color palettes. Each palette has 4 colors, 2 bytes (RGB555) per color.
+	cgb             bool
+	bgPaletteRam    [64]byte
+	objPaletteRam   [64]byte
+	bgPaletteIndex  byte
+	objPaletteIndex byte
+
+	// Debug settings, not visible to the game.
+	layers Layers
+}
+
+func MakePpuMemory(cgb bool) PpuMemory {
+	// Without boot ROM, the palettes would be uninitialized, start from white as the CGB boot ROM does.
+	var white [64]byte
+	for i := range white {
+		white[i] = 0xff
+	}
+	return PpuMemory{cgb: cgb, bgPaletteRam: white, objPaletteRam: white}
 }
 
 func (m *PpuMemory) Get(addr uint16) (byte, bool) {
@@ -56,9 +79,21 @@ func (m *PpuMemory) Get(addr uint16) (byte, bool) {
 		return m.windowX, true
 	case addrWindowY:
 		return m.windowY, true
-	default:
-		return 0, false
 	}
+
+	if m.cgb {
+		switch addr {
+		case addrBgPalIndex:
+			return m.bgPaletteIndex | 0x40, true
+		case addrBgPalData:
+			return m.bgPaletteRam[m.bgPaletteIndex&0x3f], true
+		case addrObjPalIndex:
+			return m.objPaletteIndex | 0x40, true
+		case addrObjPalData:
+			return m.objPaletteRam[m.objPaletteIndex&0x3f], true
+		}
+	}
+	return 0, false
 }
 
 func (m *PpuMemory) Set(addr uint16, v byte) bool {
@@ -97,9 +132,39 @@ func (m *PpuMemory) Set(addr uint16, v byte) bool {
 	case addrWindowY:
 		m.windowY = v
 		return true
-	default:
-		return false
 	}
+
+	if m.cgb {
+		switch addr {
+		case addrBgPalIndex:
+			m.bgPaletteIndex = v & 0xbf
+			return true
+		case addrBgPalData:
+			writePaletteRam(&m.bgPaletteRam, &m.bgPaletteIndex, v)
+			return true
+		case addrObjPalIndex:
+			m.objPaletteIndex = v & 0xbf
+			return true
+		case addrObjPalData:
+			writePaletteRam(&m.objPaletteRam, &m.objPaletteIndex, v)
+			return true
+		}
+	}
+	return false
+}
+
+// writePaletteRam writes to the palette RAM at the position in the index register, which is incremented if bit 7 is set.
+func writePaletteRam(ram *[64]byte, index *byte, v byte) {
+	ram[*index&0x3f] = v
+	if isBitSet(*index, 7) {
+		*index = 0x80 | ((*index + 1) & 0x3f)
+	}
+}
+
+// cgbColor returns the RGB555 color of a color id in one of the 8 palettes in the palette RAM.
+func cgbColor(ram *[64]byte, palette byte, colorId byte) uint16 {
+	i := int(palette)*8 + int(colorId)*2
+	return merge(ram[i+1], ram[i]) & 0x7fff
 }
 
 func (m *PpuMemory) bgWndEnabled() bool {
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestPaletteIndexAutoIncrement(t *testing.T) {
+	tests := []struct {
+		name               string
+		indexAddr, ramAddr uint16
+	}{
+		{"background", addrBgPalIndex, addrBgPalData},
+		{"objects", addrObjPalIndex, addrObjPalData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := MakePpuMemory(true)
+			mem.Set(tt.indexAddr, 0xbe) // Auto-increment, index 0x3e
+			for _, v := range []byte{0x11, 0x22, 0x33} {
+				mem.Set(tt.ramAddr, v)
+			}
+			// The index wraps from 0x3f to 0, bit 6 reads as 1.
+			if got, _ := mem.Get(tt.indexAddr); got != 0xc1 {
+				t.Errorf("Index is 0x%02x, want 0xc1", got)
+			}
+			mem.Set(tt.indexAddr, 0x3f) // No auto-increment
+			mem.Set(tt.ramAddr, 0x44)
+			mem.Set(tt.ramAddr, 0x55)
+			if got, _ := mem.Get(tt.indexAddr); got != 0x7f {
+				t.Errorf("Index without auto-increment is 0x%02x, want 0x7f", got)
+			}
+			for i, want := range map[byte]byte{0x3e: 0x11, 0x3f: 0x55, 0x00: 0x33} {
+				mem.Set(tt.indexAddr, i)
+				if got, _ := mem.Get(tt.ramAddr); got != want {
+					t.Errorf("Palette RAM at 0x%02x is 0x%02x, want 0x%02x", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -5,9 +5,17 @@ type ObjEntry struct {
 	pixel  byte
 }
 
+// BgEntry is a background or window pixel.
+type BgEntry struct {
+	pixel  byte
+	window bool
+	// CGB only: attributes of the tile the pixel belongs to.
+	attrs byte
+}
+
 type PpuRenderer struct {
 	mem               *PpuMemory
-	bgFifo            []byte
+	bgFifo            []BgEntry
 	objFifo           []ObjEntry
 	bgFetcher         PpuFetcher
 	objFetcher        PpuFetcher
@@ -16,9 +24,17 @@ type PpuRenderer struct {
 	row, col          int
 	step              int
 	windowLineCounter int
-	bgPalette         [4]byte
-	spritePalette0    [4]byte
-	spritePalette1    [4]byte
+	// The fine scroll (SCX % 8) is latched at the start of the line, the rest of SCX is read by the fetcher.
+	fineScrollX byte
+	// Number of pixels to drop from the next fetched tile: the fine scroll for the background or, with WX<7, the part
+	// of the window that is off-screen.
+	discardPixels byte
+	// Whether LY matched WY at the start of a line in the current frame. Once latched, the window can be displayed on
+	// all the following lines, even if WY changes.
+	windowYTriggered bool
+	// Hardware glitch: when the window is triggered with WX=166, it spans the entirety of the following line.
+	windowGlitchNextLine bool
+	windowFullLine       bool
 
 	mainMem *Mcu
 }
@@ -35,6 +51,9 @@ func MakePpuRenderer(mcu *Mcu, mem *PpuMemory, pixelSetter PixelSetter) *PpuRend
 func (p *PpuRenderer) Clear() {
 	p.SetRow(0, []Sprite{})
 	p.windowLineCounter = 0
+	p.windowYTriggered = false
+	p.windowGlitchNextLine = false
+	p.windowFullLine = false
 }
 
 func (p *PpuRenderer) SetRow(row byte, sprites []Sprite) {
@@ -42,23 +61,22 @@ func (p *PpuRenderer) SetRow(row byte, sprites []Sprite) {
 	p.row = int(row)
 	p.col = 0
 	p.sprites = sprites
+	p.fineScrollX = p.mem.lcdScrollX % 8
+	p.discardPixels = p.fineScrollX
 
-	p.bgPalette = makePalette(p.mem.bgPalette)
-	p.spritePalette0 = makePalette(p.mem.objPalette0)
-	p.spritePalette1 = makePalette(p.mem.objPalette1)
+	if p.mem.windowY == row {
+		p.windowYTriggered = true
+	}
+	p.windowFullLine = p.windowGlitchNextLine
+	p.windowGlitchNextLine = false
 
 	p.objFetcher.SetRow(p.row)
-	// Update addresses, in case the program moved the tiles somewhere else
-	p.objFetcher.updateAddresses()
 	p.objFifo = make([]ObjEntry, 0, 8)
 
-	scRow := (p.row + int(p.mem.lcdScrollY)) % 256
-	scCol := (p.col + int(p.mem.lcdScrollX)) % 256
-	p.bgFetcher.SetRow(scRow)
-	p.bgFetcher.col = scCol / 8 * 8
 	// Re-set the fetcher type in case we switched it to Window previously
 	p.bgFetcher.SetFetcherType(Background)
-	p.bgFifo = make([]byte, 0, 16)
+	p.bgFetcher.SetRow(p.row)
+	p.bgFifo = make([]BgEntry, 0, 16)
 }
 
 func (p *PpuRenderer) Tick() {
@@ -68,41 +86,43 @@ func (p *PpuRenderer) Tick() {
 		return
 	}
 
-	// Switch fetcher to window
-	if p.mem.wndEnabled() && p.bgFetcher.fetcherType == Background &&
-		byte(p.row) >= p.mem.windowY && byte(p.col) == p.mem.windowX-7 {
-		p.bgFetcher.SetFetcherType(Window)
-		p.bgFetcher.SetRow(p.windowLineCounter)
-		p.bgFetcher.col = 0
-		p.bgFifo = p.bgFifo[:0]
-		p.windowLineCounter++
+	if p.bgFetcher.fetcherType == Background {
+		if p.mem.wndEnabled() && p.windowYTriggered {
+			p.checkWindowStart()
+		}
+	} else if !p.mem.wndEnabled() {
+		// The window was disabled in the middle of the line, go back to the background after the pixels in the FIFO.
+		// With the fine scroll, that column can be in the middle of a background tile: the pixels of the tile before
+		// it are dropped.
+		p.bgFetcher.SetFetcherType(Background)
+		p.bgFetcher.SetRow(p.row)
+		col := p.col + len(p.bgFifo) + int(p.fineScrollX)
+		p.bgFetcher.col = col / 8 * 8
+		p.discardPixels = byte(col % 8)
 	}
 
 	if len(p.bgFifo) < 8 {
 		// Not enough pixels to draw, fetch a new tile.
-		isFirstTile := (int(p.mem.lcdScrollX) / 8 * 8) == p.bgFetcher.col
 		pixels := p.bgFetcher.GetNextPixels()
-		if isFirstTile && p.mem.lcdScrollX%8 != 0 {
-			// We are scrolled in-between a tile, so insert into the renderer the remaining pixels of that tile and
-			// fetch the next tile.
-			offset := p.mem.lcdScrollX % 8
-			for i := offset; i < 8; i++ {
-				p.bgFifo = append(p.bgFifo, pixels[i])
-			}
+		if p.discardPixels != 0 {
+			// The tile is partially off-screen (e.g. we are scrolled in-between a tile), so insert into the renderer the
+			// remaining pixels of that tile and fetch the next tile.
+			p.pushBgPixels(pixels[p.discardPixels:])
+			p.discardPixels = 0
 			pixels = p.bgFetcher.GetNextPixels()
 		}
-		p.bgFifo = append(p.bgFifo, pixels[0], pixels[1], pixels[2], pixels[3], pixels[4], pixels[5], pixels[6], pixels[7])
+		p.pushBgPixels(pixels[:])
 	}
 
 	if len(p.bgFifo) >= 8 {
-		// We have pixels ready to draw, check if there's an overlapping sprite at this column.
-		if len(p.sprites) > 0 && byte(p.col)+8 >= p.sprites[0].x {
+		// We have pixels ready to draw, check if there are overlapping sprites at this column. Several sprites can
+		// start at the same column, all of them are loaded before the pixel is drawn.
+		for len(p.sprites) > 0 && p.col+8 >= int(p.sprites[0].x) {
 			p.loadNextSprite()
 		}
 
 		// Output a pixel
-		pixelColor := p.calcPixelColor()
-		p.pixelSetter.SetPixel(p.row, p.col, pixelColor)
+		p.outputPixel()
 		p.col++
 
 		// Advance the FIFOs
@@ -116,6 +136,44 @@ func (p *PpuRenderer) Tick() {
 	p.step++
 }
 
+func (p *PpuRenderer) pushBgPixels(pixels []byte) {
+	for _, pixel := range pixels {
+		p.bgFifo = append(p.bgFifo, BgEntry{
+			pixel:  pixel,
+			window: p.bgFetcher.fetcherType == Window,
+			attrs:  p.bgFetcher.tileAttrs,
+		})
+	}
+}
+
+// checkWindowStart switches the fetcher to the window if it starts at the current column.
+func (p *PpuRenderer) checkWindowStart() {
+	wx := int(p.mem.windowX)
+	switch {
+	case p.windowFullLine && p.col == 0:
+		p.startWindow(0)
+	case wx < 7 && p.col == 0:
+		// The window starts off-screen, drop the pixels to the left of the LCD.
+		p.startWindow(byte(7 - wx))
+	case wx >= 7 && p.col == wx-7:
+		p.startWindow(0)
+		if wx == 166 {
+			p.windowGlitchNextLine = true
+		}
+	}
+}
+
+func (p *PpuRenderer) startWindow(discardPixels byte) {
+	p.bgFetcher.SetFetcherType(Window)
+	p.bgFetcher.SetRow(p.windowLineCounter)
+	p.bgFetcher.col = 0
+	p.bgFifo = p.bgFifo[:0]
+	p.discardPixels = discardPixels
+	// The counter is only incremented on lines where the window is actually drawn, so the window continues from where
+	// it left off when it is re-enabled later in the frame.
+	p.windowLineCounter++
+}
+
 func (p *PpuRenderer) IsDone() bool {
 	// TODO: 172 is the shortest duration of the renderer. Instead of this, we should use appropriate timing.
 	return p.step == 172
@@ -126,54 +184,97 @@ func (p *PpuRenderer) loadNextSprite() {
 	p.objFetcher.SetSprite(&sprite)
 	spritePixels := p.objFetcher.GetNextPixels()
 
+	// Skip the pixels of the sprite that are left of the current column (e.g. sprites partially off-screen with x<8).
+	offset := min(p.col+8-int(sprite.x), len(spritePixels))
+
 	// The pixels that overlap with the current sprite need to be mixed.
-	// The previous sprite goes on top, unless it is transparent.
+	// The previous sprite goes on top, unless it is transparent. On CGB, the sprite first in OAM goes on top.
 	i := 0
-	for ; i < len(p.objFifo); i++ {
-		if p.objFifo[i].pixel == 0 {
-			p.objFifo[i] = ObjEntry{sprite: &sprite, pixel: spritePixels[i]}
+	for ; i < len(p.objFifo) && offset+i < len(spritePixels); i++ {
+		pixel := spritePixels[offset+i]
+		if p.objFifo[i].pixel == 0 || (p.mem.cgb && pixel != 0 && sprite.id < p.objFifo[i].sprite.id) {
+			p.objFifo[i] = ObjEntry{sprite: &sprite, pixel: pixel}
 		}
 	}
 
 	// All the remaining pixels can go in the fifo directly.
-	for ; i < len(spritePixels); i++ {
-		p.objFifo = append(p.objFifo, ObjEntry{sprite: &sprite, pixel: spritePixels[i]})
+	for ; offset+i < len(spritePixels); i++ {
+		p.objFifo = append(p.objFifo, ObjEntry{sprite: &sprite, pixel: spritePixels[offset+i]})
 	}
 	p.sprites = p.sprites[1:]
 }
 
-func (p *PpuRenderer) calcPixelColor() byte {
-	bgColor := p.bgFifo[0]
-
-	var objColor byte
-	var bgPriority bool
+// outputPixel mixes the background and object pixels at the head of the FIFOs. The palettes and LCDC are read here,
+// when the pixel is pushed to the LCD, so that writes in the middle of a line affect the following pixels.
+func (p *PpuRenderer) outputPixel() {
+	var obj ObjEntry
 	if len(p.objFifo) > 0 {
-		objColor = p.objFifo[0].pixel
-		bgPriority = p.objFifo[0].sprite.bgPriority
+		obj = p.objFifo[0]
+	}
+	outputPixel(p.pixelSetter, p.mem, p.row, p.col, p.bgFifo[0], obj)
+}
+
+// outputPixel mixes a background and an object pixel, and sends the result to the pixel setter.
+func outputPixel(pixelSetter PixelSetter, mem *PpuMemory, row int, col int, bg BgEntry, obj ObjEntry) {
+	bg, obj = mem.layers.filter(bg, obj)
+	if mem.cgb {
+		color, source := mixCgbPixel(mem, bg, obj)
+		if mem.layers.tint.Load() {
+			color = tintColor(color, source)
+		}
+		pixelSetter.SetColorPixel(row, col, color)
+		return
+	}
+
+	shade, source := mixPixel(mem, bg, obj)
+	if mem.layers.tint.Load() {
+		pixelSetter.SetColorPixel(row, col, tintColor(shadeColor(shade), source))
 	} else {
-		objColor = 0
-		bgPriority = false
+		pixelSetter.SetPixel(row, col, shade, source)
 	}
+}
 
-	if objColor == 0 || (bgPriority && bgColor != 0) {
+// mixPixel returns the shade of an LCD pixel and where it comes from, given the background pixel and the object pixel
+// on top of it. If there's no object, obj.sprite is nil.
+func mixPixel(mem *PpuMemory, bg BgEntry, obj ObjEntry) (byte, PixelSource) {
+	if obj.sprite == nil || obj.pixel == 0 || !mem.lcdObjEnabled() || (obj.sprite.bgPriority && bg.pixel != 0) {
 		// Background pixel
-		if p.mem.bgWndEnabled() {
-			return p.bgPalette[bgColor]
+		source := SourceBackground
+		if bg.window {
+			source = SourceWindow
+		}
+		if mem.bgWndEnabled() {
+			return paletteColor(mem.bgPalette, bg.pixel), source
 		}
-		return p.bgPalette[0]
+		return paletteColor(mem.bgPalette, 0), source
 	}
 
 	// Sprite pixel
-	if p.objFifo[0].sprite.palette0 {
-		return p.spritePalette0[objColor]
+	if obj.sprite.palette0 {
+		return paletteColor(mem.objPalette0, obj.pixel), SourceObject0
+	}
+	return paletteColor(mem.objPalette1, obj.pixel), SourceObject1
+}
+
+// mixCgbPixel is like mixPixel, but for CGB mode. Returns a RGB555 color. All sprites are reported as SourceObject0,
+// since OBP0/OBP1 are not used on CGB.
+func mixCgbPixel(mem *PpuMemory, bg BgEntry, obj ObjEntry) (uint16, PixelSource) {
+	if obj.sprite != nil && obj.pixel != 0 && mem.lcdObjEnabled() {
+		// On CGB, LCDC bit 0 is the master priority: when off, sprites are always on top of the background.
+		bgOnTop := mem.bgWndEnabled() && bg.pixel != 0 &&
+			(isBitSet(bg.attrs, tileAttrPriority) || obj.sprite.bgPriority)
+		if !bgOnTop {
+			return cgbColor(&mem.objPaletteRam, obj.sprite.cgbPalette, obj.pixel), SourceObject0
+		}
+	}
+	source := SourceBackground
+	if bg.window {
+		source = SourceWindow
 	}
-	return p.spritePalette1[objColor]
+	return cgbColor(&mem.bgPaletteRam, bg.attrs&0x7, bg.pixel), source
 }
 
-func makePalette(v byte) [4]byte {
-	return [4]byte{
-		v & 0x3,
-		(v & 0xc) >> 2,
-		(v & 0x30) >> 4,
-		(v & 0xc0) >> 6}
+// paletteColor returns the shade (0-3) that the given palette register assigns to a color id.
+func paletteColor(palette byte, colorId byte) byte {
+	return (palette >> (colorId * 2)) & 0x3
 }
@@ -0,0 +1,229 @@
+package main
+
+import "testing"
+
+// framePixels keeps the DMG pixels of a frame.
+type framePixels struct {
+	shades  [DisplayHeight][DisplayWidth]byte
+	sources [DisplayHeight][DisplayWidth]PixelSource
+}
+
+func (f *framePixels) SetPixel(r int, c int, color byte, source PixelSource) {
+	f.shades[r][c], f.sources[r][c] = color, source
+}
+
+func (f *framePixels) SetColorPixel(int, int, uint16) {}
+
+// renderFrame draws a frame of a background of random tiles with the FIFO renderer, without sprites. setup writes the
+// registers before the frame. If write isn't nil, it is called before each dot of the rendering mode, with the line and
+// the column about to be drawn.
+func renderFrame(setup func(mcu *Mcu), write func(mcu *Mcu, row int, col int)) *framePixels {
+	rom := makeTestRom(0x00, 0x18, 0xfe) // JR -2
+	emulator := MakeEmulator(nil, rom, EmulatorOptions{}, headlessDisplay{})
+	mcu := emulator.mcu
+	seed := uint32(1)
+	for addr := uint16(0x8000); addr < 0xa000; addr++ {
+		seed = seed*1103515245 + 12345
+		mcu.Set(addr, byte(seed>>16))
+	}
+	mcu.Set(addrLcdControl, 0x91) // LCD, tile data at 0x8000, background
+	mcu.Set(addrBgPalette, 0xe4)
+	setup(mcu)
+
+	pixels := &framePixels{}
+	renderer := MakePpuRenderer(mcu, emulator.ppuMemory, pixels)
+	renderer.Clear()
+	for row := 0; row < DisplayHeight; row++ {
+		renderer.SetRow(byte(row), nil)
+		for !renderer.IsDone() {
+			if write != nil {
+				write(mcu, row, renderer.col)
+			}
+			renderer.Tick()
+		}
+	}
+	return pixels
+}
+
+// setRegister returns a setup function that writes a register.
+func setRegister(addr uint16, v byte) func(mcu *Mcu) {
+	return func(mcu *Mcu) {
+		mcu.Set(addr, v)
+	}
+}
+
+func TestMidLineWrites(t *testing.T) {
+	const writeRow, writeCol = 10, 40
+	tests := []struct {
+		name  string
+		addr  uint16
+		value byte
+		// The first column drawn with the new value on the line of the write.
+		wantCol int
+	}{
+		// The palettes and LCDC are read when a pixel is pushed to the LCD.
+		{"BGP", addrBgPalette, 0x1b, writeCol},
+		{"LCDC background off", addrLcdControl, 0x90, writeCol},
+		// SCX is read when a tile is fetched: the tile already in the FIFO has the old scroll.
+		{"SCX", addrLcdScrollX, 16, writeCol + 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := renderFrame(func(*Mcu) {}, nil)
+			after := renderFrame(setRegister(tt.addr, tt.value), nil)
+			pixels := renderFrame(func(*Mcu) {}, func(mcu *Mcu, row int, col int) {
+				if row == writeRow && col == writeCol {
+					mcu.Set(tt.addr, tt.value)
+				}
+			})
+			for row := 0; row < DisplayHeight; row++ {
+				for col := 0; col < DisplayWidth; col++ {
+					want := after.shades[row][col]
+					if row < writeRow || (row == writeRow && col < tt.wantCol) {
+						want = before.shades[row][col]
+					}
+					if pixels.shades[row][col] != want {
+						t.Fatalf("Pixel (%d, %d) is %d, want %d", row, col, pixels.shades[row][col], want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// showWindow returns a setup function that enables the window at the given position. The window and the background
+// use the same tile map, so a window line is drawn like the line of the background at the same height, without scroll.
+func showWindow(wx byte, wy byte) func(mcu *Mcu) {
+	return func(mcu *Mcu) {
+		mcu.Set(addrWindowX, wx)
+		mcu.Set(addrWindowY, wy)
+		mcu.Set(addrLcdControl, 0xb1)
+	}
+}
+
+func TestWindowDisabledMidLine(t *testing.T) {
+	for scx := byte(0); scx < 8; scx++ {
+		for _, windowUntil := range []int{20, 43} {
+			background := renderFrame(setRegister(addrLcdScrollX, scx), nil)
+			pixels := renderFrame(func(mcu *Mcu) {
+				showWindow(7, 0)(mcu)
+				mcu.Set(addrLcdScrollX, scx)
+			}, func(mcu *Mcu, row int, col int) {
+				if col == windowUntil {
+					mcu.Set(addrLcdControl, 0x91)
+				}
+			})
+			numWindow := 0
+			for col := range pixels.shades[0] {
+				if pixels.sources[0][col] == SourceWindow {
+					numWindow++
+					continue
+				}
+				if pixels.shades[0][col] != background.shades[0][col] {
+					t.Errorf("SCX=%d, window until %d: column %d is %d, want the background %d", scx, windowUntil,
+						col, pixels.shades[0][col], background.shades[0][col])
+					break
+				}
+			}
+			if numWindow < windowUntil {
+				t.Errorf("SCX=%d: the window is drawn on %d columns, want at least %d", scx, numWindow, windowUntil)
+			}
+		}
+	}
+}
+
+func TestWindowXBelow7(t *testing.T) {
+	for wx := byte(0); wx < 7; wx++ {
+		// The 7-WX pixels of the window left of the LCD are dropped, like a background scrolled by 7-WX.
+		scrolled := renderFrame(setRegister(addrLcdScrollX, 7-wx), nil)
+		pixels := renderFrame(showWindow(wx, 0), nil)
+		for row := 0; row < DisplayHeight; row++ {
+			for col := 0; col < DisplayWidth; col++ {
+				if pixels.sources[row][col] != SourceWindow || pixels.shades[row][col] != scrolled.shades[row][col] {
+					t.Fatalf("WX=%d: pixel (%d, %d) is %d from %d, want %d from the window", wx, row, col,
+						pixels.shades[row][col], pixels.sources[row][col], scrolled.shades[row][col])
+				}
+			}
+		}
+	}
+}
+
+func TestWindowX166(t *testing.T) {
+	background := renderFrame(func(*Mcu) {}, nil)
+	pixels := renderFrame(showWindow(166, 0), nil)
+	for col := 0; col < DisplayWidth; col++ {
+		// The window only covers the last column of the first line.
+		if got, want := pixels.sources[0][col] == SourceWindow, col == DisplayWidth-1; got != want {
+			t.Errorf("Column %d of the first line is from the window: %v, want %v", col, got, want)
+		}
+		// Because of the glitch, it covers the whole second line, which shows the second line of the window.
+		if pixels.sources[1][col] != SourceWindow || pixels.shades[1][col] != background.shades[1][col] {
+			t.Errorf("Column %d of the second line is %d from %d, want %d from the window", col,
+				pixels.shades[1][col], pixels.sources[1][col], background.shades[1][col])
+		}
+	}
+}
+
+func TestWindowYLatch(t *testing.T) {
+	tests := []struct {
+		name string
+		wy   byte
+		// WY is changed to writeValue before drawing the given column of the given line.
+		writeRow, writeCol int
+		writeValue         byte
+		// The first line with the window, -1 if there is none.
+		wantRow int
+	}{
+		{"WY set before the frame", 20, -1, 0, 0, 20},
+		{"WY changed before the line", 100, 30, 0, 50, 50},
+		{"WY changed after the window is triggered", 20, 30, 0, 100, 20},
+		// WY is compared with LY at the start of the line only.
+		{"WY matching in the middle of the line", 100, 40, 80, 40, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			background := renderFrame(func(*Mcu) {}, nil)
+			pixels := renderFrame(showWindow(7, tt.wy), func(mcu *Mcu, row int, col int) {
+				if row == tt.writeRow && col == tt.writeCol {
+					mcu.Set(addrWindowY, tt.writeValue)
+				}
+			})
+			for row := 0; row < DisplayHeight; row++ {
+				wantWindow := tt.wantRow >= 0 && row >= tt.wantRow
+				if got := pixels.sources[row][0] == SourceWindow; got != wantWindow {
+					t.Fatalf("Line %d starts with the window: %v, want %v", row, got, wantWindow)
+				}
+				if wantWindow && pixels.shades[row] != background.shades[row-tt.wantRow] {
+					t.Fatalf("Line %d doesn't show the line %d of the window", row, row-tt.wantRow)
+				}
+			}
+		})
+	}
+}
+
+func TestWindowLineCounter(t *testing.T) {
+	background := renderFrame(func(*Mcu) {}, nil)
+	// The window is disabled on the lines 10 to 19.
+	pixels := renderFrame(showWindow(7, 0), func(mcu *Mcu, row int, col int) {
+		if row == 10 && col == 0 {
+			mcu.Set(addrLcdControl, 0x91)
+		} else if row == 20 && col == 0 {
+			mcu.Set(addrLcdControl, 0xb1)
+		}
+	})
+	for row := 0; row < DisplayHeight; row++ {
+		wantWindow, wantLine := true, row
+		if row >= 10 && row < 20 {
+			wantWindow = false
+		} else if row >= 20 {
+			// The window continues from the line where it was disabled.
+			wantLine = row - 10
+		}
+		if got := pixels.sources[row][0] == SourceWindow; got != wantWindow {
+			t.Fatalf("Line %d starts with the window: %v, want %v", row, got, wantWindow)
+		}
+		if pixels.shades[row] != background.shades[wantLine] {
+			t.Fatalf("Line %d doesn't show the line %d", row, wantLine)
+		}
+	}
+}
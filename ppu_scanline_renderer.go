@@ -0,0 +1,179 @@
+package main
+
+import "sort"
+
+// ScanlineRenderer is a faster alternative to PpuRenderer. Instead of emulating the pixel FIFOs, it draws the whole
+// line in one pass at the end of the Rendering mode, reading tiles and sprites directly from VRAM and OAM.
+// The output is identical to PpuRenderer, except for games that change registers in the middle of a line.
+type ScanlineRenderer struct {
+	mcu               *Mcu
+	mem               *PpuMemory
+	pixelSetter       PixelSetter
+	sprites           []Sprite
+	row               int
+	step              int
+	windowLineCounter int
+	// See PpuRenderer for the window quirks.
+	windowYTriggered     bool
+	windowGlitchNextLine bool
+	windowFullLine       bool
+}
+
+func MakeScanlineRenderer(mcu *Mcu, mem *PpuMemory, pixelSetter PixelSetter) *ScanlineRenderer {
+	return &ScanlineRenderer{mcu: mcu, mem: mem, pixelSetter: pixelSetter}
+}
+
+func (s *ScanlineRenderer) Clear() {
+	s.SetRow(0, []Sprite{})
+	s.windowLineCounter = 0
+	s.windowYTriggered = false
+	s.windowGlitchNextLine = false
+	s.windowFullLine = false
+}
+
+func (s *ScanlineRenderer) SetRow(row byte, sprites []Sprite) {
+	s.step = 0
+	s.row = int(row)
+	s.sprites = sprites
+
+	if s.mem.windowY == row {
+		s.windowYTriggered = true
+	}
+	s.windowFullLine = s.windowGlitchNextLine
+	s.windowGlitchNextLine = false
+}
+
+func (s *ScanlineRenderer) Tick() {
+	s.step++
+	if s.IsDone() {
+		s.renderLine()
+	}
+}
+
+func (s *ScanlineRenderer) IsDone() bool {
+	// Same duration as PpuRenderer.
+	return s.step == 172
+}
+
+func (s *ScanlineRenderer) renderLine() {
+	var bgPixels [DisplayWidth]BgEntry
+	s.renderBackground(&bgPixels)
+	s.renderWindow(&bgPixels)
+
+	var objs [DisplayWidth]ObjEntry
+	s.renderSprites(&objs)
+
+	for col := 0; col < DisplayWidth; col++ {
+		outputPixel(s.pixelSetter, s.mem, s.row, col, bgPixels[col], objs[col])
+	}
+}
+
+func (s *ScanlineRenderer) renderBackground(pixels *[DisplayWidth]BgEntry) {
+	tileMap := tileMaps[0]
+	if s.mem.lcdBgTileMap() {
+		tileMap = tileMaps[1]
+	}
+	mapRow := (s.row + int(s.mem.lcdScrollY)) % 256
+	for col := 0; col < DisplayWidth; col++ {
+		mapCol := (col + int(s.mem.lcdScrollX)) % 256
+		pixels[col] = s.tilePixel(tileMap, mapRow, mapCol)
+	}
+}
+
+func (s *ScanlineRenderer) renderWindow(pixels *[DisplayWidth]BgEntry) {
+	if !s.mem.wndEnabled() || !s.windowYTriggered {
+		return
+	}
+
+	startCol := int(s.mem.windowX) - 7
+	if s.windowFullLine {
+		startCol = 0
+	} else if startCol >= DisplayWidth {
+		return
+	} else if startCol == DisplayWidth-1 {
+		s.windowGlitchNextLine = true
+	}
+
+	tileMap := tileMaps[0]
+	if s.mem.lcdWndTileMap() {
+		tileMap = tileMaps[1]
+	}
+	for col := max(startCol, 0); col < DisplayWidth; col++ {
+		pixels[col] = s.tilePixel(tileMap, s.windowLineCounter, col-startCol)
+		pixels[col].window = true
+	}
+	s.windowLineCounter++
+}
+
+// tilePixel returns the pixel at the given position of the background or window tile map.
+func (s *ScanlineRenderer) tilePixel(tileMap uint16, mapRow int, mapCol int) BgEntry {
+	tileIndex := ((mapRow / 8) * 32) + (mapCol / 8)
+	mapOffset := tileMap + uint16(tileIndex) - addrRomEnd
+	tileId := s.mcu.vram[0][mapOffset]
+
+	tileRow, tileCol := mapRow%8, mapCol%8
+	var attrs byte
+	bank := 0
+	if s.mem.cgb {
+		attrs = s.mcu.vram[1][mapOffset]
+		if isBitSet(attrs, tileAttrBank) {
+			bank = 1
+		}
+		if isBitSet(attrs, tileAttrYFlip) {
+			tileRow = 7 - tileRow
+		}
+		if isBitSet(attrs, tileAttrXFlip) {
+			tileCol = 7 - tileCol
+		}
+	}
+
+	// Same addressing as PpuFetcher: with LCDC.4 off, tiles 0-127 are in the third block.
+	tileBlockStart := tileBlocks[0]
+	if !s.mem.lcdBgWndTiles() && tileId < 128 {
+		tileBlockStart = tileBlocks[2]
+	} else if tileId >= 128 {
+		tileBlockStart = tileBlocks[1]
+	}
+	tileStart := tileBlockStart + 16*uint16(tileId%128) + uint16(tileRow)*2 - addrRomEnd
+	pixel := tileDataPixel(s.mcu.vram[bank][tileStart], s.mcu.vram[bank][tileStart+1], tileCol)
+	return BgEntry{pixel: pixel, attrs: attrs}
+}
+
+func (s *ScanlineRenderer) renderSprites(objs *[DisplayWidth]ObjEntry) {
+	if s.mem.cgb {
+		// On CGB, the priority is the position in OAM instead of the x coordinate.
+		sort.Slice(s.sprites, func(i, j int) bool {
+			return s.sprites[i].id < s.sprites[j].id
+		})
+	}
+
+	// Sprites are sorted by priority: a sprite is drawn unless a previous one has a non-transparent pixel.
+	for i := range s.sprites {
+		sprite := &s.sprites[i]
+		tileId, tileRow := spriteTile(s.mem, sprite, s.row)
+		tileStart := tileBlocks[0] + 16*uint16(tileId) + uint16(tileRow)*2 - addrRomEnd
+		bank := 0
+		if s.mem.cgb {
+			bank = int(sprite.vramBank)
+		}
+		tileData0, tileData1 := s.mcu.vram[bank][tileStart], s.mcu.vram[bank][tileStart+1]
+
+		for x := 0; x < 8; x++ {
+			col := int(sprite.x) - 8 + x
+			if col < 0 || col >= DisplayWidth || objs[col].pixel != 0 {
+				continue
+			}
+			tileCol := x
+			if sprite.xFlip {
+				tileCol = 7 - x
+			}
+			objs[col] = ObjEntry{sprite: sprite, pixel: tileDataPixel(tileData0, tileData1, tileCol)}
+		}
+	}
+}
+
+// tileDataPixel returns the color id of a pixel in a tile row, given the 2 bytes of data of that row.
+func tileDataPixel(tileData0 byte, tileData1 byte, col int) byte {
+	bit := 7 - col
+	return (tileData1>>bit&1)<<1 | tileData0>>bit&1
+}
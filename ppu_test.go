@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+// renderSprites draws a frame of random tiles, with 8x8 sprites at the given X positions on the first lines.
+func renderSprites(fastPpu bool, xs []byte) *framePixels {
+	rom := makeTestRom(0x00, 0x18, 0xfe) // JR -2
+	pixels := &framePixels{}
+	emulator := MakeEmulator(nil, rom, EmulatorOptions{fastPpu: fastPpu}, pixels)
+	mcu := emulator.mcu
+	seed := uint32(1)
+	for addr := uint16(0x8000); addr < 0xa000; addr++ {
+		seed = seed*1103515245 + 12345
+		mcu.Set(addr, byte(seed>>16))
+	}
+	for i, x := range xs {
+		sprite := addrEchoRamEnd + 4*uint16(i)
+		mcu.Set(sprite, byte(16+i))     // Y
+		mcu.Set(sprite+1, x)            // X
+		mcu.Set(sprite+2, byte(i))      // Tile
+		mcu.Set(sprite+3, byte(i&1)<<4) // Attributes: OBP0 or OBP1
+	}
+	mcu.Set(addrObjPalette0, 0xe4)
+	mcu.Set(addrObjPalette1, 0x1b)
+	mcu.Set(addrLcdControl, 0x93)
+
+	for i := 0; i < ticksPerFrame*4; i++ {
+		emulator.ppu.Tick()
+	}
+	return pixels
+}
+
+func TestRenderersDrawTheSameSprites(t *testing.T) {
+	tests := []struct {
+		name string
+		xs   []byte
+	}{
+		{"sprites starting at the same column", []byte{40, 40, 40, 80, 80}},
+		{"sprites partially left of the LCD", []byte{1, 3, 5, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fifo := renderSprites(false, tt.xs)
+			scanline := renderSprites(true, tt.xs)
+			for row := 0; row < DisplayHeight; row++ {
+				for col := 0; col < DisplayWidth; col++ {
+					if fifo.shades[row][col] != scanline.shades[row][col] ||
+						fifo.sources[row][col] != scanline.sources[row][col] {
+						t.Fatalf("Pixel (%d, %d) is %d from %d, the scanline renderer draws %d from %d", row, col,
+							fifo.shades[row][col], fifo.sources[row][col], scanline.shades[row][col],
+							scanline.sources[row][col])
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPpuRenderer(b *testing.B) {
+	benchmarkRenderer(b, false)
+}
+
+func BenchmarkScanlineRenderer(b *testing.B) {
+	benchmarkRenderer(b, true)
+}
+
+// benchmarkRenderer draws whole frames of a scrolled background with 8x16 sprites, up to 6 on a line.
+func benchmarkRenderer(b *testing.B, fastPpu bool) {
+	rom := makeTestRom(0x00, 0x18, 0xfe) // JR -2
+	emulator := MakeEmulator(nil, rom, EmulatorOptions{fastPpu: fastPpu}, headlessDisplay{})
+	mcu := emulator.mcu
+	for addr := uint16(0x8000); addr < 0xa000; addr++ {
+		mcu.Set(addr, byte(addr*7))
+	}
+	for i := uint16(0); i < 40; i++ {
+		mcu.Set(addrEchoRamEnd+4*i, byte(16+3*i))  // Y
+		mcu.Set(addrEchoRamEnd+4*i+1, byte(8+4*i)) // X
+		mcu.Set(addrEchoRamEnd+4*i+2, byte(i))     // Tile
+		mcu.Set(addrEchoRamEnd+4*i+3, byte(i<<4))  // Attributes
+	}
+	mcu.Set(addrLcdScrollX, 3)
+	mcu.Set(addrLcdControl, 0x97)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < ticksPerFrame*4; i++ {
+			emulator.ppu.Tick()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"strings"
+	"time"
+)
+
+// captureFileName returns the name of the file for a screenshot or a recording of the given game, taken at the given
+// time.
+func captureFileName(title string, t time.Time, extension string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, title)
+	if len(name) == 0 {
+		name = "goodboy"
+	}
+	return fmt.Sprintf("%s-%s.%s", name, t.Format("20060102-150405.000"), extension)
+}
+
+// rgbaImage creates an image from RGBA pixels, each pixel is repeated scale times in both directions.
+func rgbaImage(pixels []byte, width int, height int, scale int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width*scale, height*scale))
+	for y := 0; y < height*scale; y++ {
+		for x := 0; x < width*scale; x++ {
+			src := ((y/scale)*width + x/scale) * bytesPerPixel
+			copy(img.Pix[img.PixOffset(x, y):], pixels[src:src+bytesPerPixel])
+		}
+	}
+	return img
+}
+
+// SavePng writes the image to a PNG file.
+func SavePng(img image.Image, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,455 @@
+package main
+
+const (
+	addrSgbFlag      = 0x146
+	addrOldLicensee  = 0x14b
+	SgbBorderWidth   = 256
+	SgbBorderHeight  = 224
+	sgbPacketSize    = 16
+	sgbTransferSize  = 4096
+	sgbAttrCols      = DisplayWidth / 8
+	sgbAttrRows      = DisplayHeight / 8
+	sgbAttrFileSize  = sgbAttrCols * sgbAttrRows / 4
+	sgbNumAttrFiles  = 45
+	sgbNumSysPalette = 512
+	sgbBorderTiles   = 256
+	sgbBorderMapCols = SgbBorderWidth / 8
+	sgbBorderMapRows = SgbBorderHeight / 8
+)
+
+// SGB commands, the first 5 bits of a packet.
+const (
+	sgbPal01   = 0x00
+	sgbPal23   = 0x01
+	sgbPal03   = 0x02
+	sgbPal12   = 0x03
+	sgbAttrBlk = 0x04
+	sgbAttrLin = 0x05
+	sgbAttrDiv = 0x06
+	sgbAttrChr = 0x07
+	sgbPalSet  = 0x0a
+	sgbPalTrn  = 0x0b
+	sgbMltReq  = 0x11
+	sgbChrTrn  = 0x13
+	sgbPctTrn  = 0x14
+	sgbAttrTrn = 0x15
+	sgbAttrSet = 0x16
+	sgbMaskEn  = 0x17
+)
+
+// Values of MASK_EN.
+const (
+	sgbMaskCancel = iota
+	sgbMaskFreeze
+	sgbMaskBlack
+	sgbMaskColor0
+)
+
+// Grey shades used until the game sets its palettes, in RGB555.
+var sgbDefaultPalette = [4]uint16{0x7fff, 0x56b5, 0x294a, 0x0000}
+
+// BorderSetter receives the SGB border, drawn around the game screen.
+type BorderSetter interface {
+	// SetBorder sets the 256x224 border, in RGB555. The game screen is drawn on top, in the middle.
+	SetBorder(border *[SgbBorderWidth * SgbBorderHeight]uint16)
+}
+
+// Sgb emulates the Super Game Boy. Games send commands to it as packets, through the joypad register, to color the
+// screen (4 palettes assigned to regions of the screen), show a border around the screen or enable multiplayer.
+// Sgb sits between the PPU and the display: it receives DMG shades and outputs colored pixels.
+type Sgb struct {
+	display      PixelSetter
+	borderSetter BorderSetter
+
+	// Packet reception: bits are sent with pulses on P14 (0) and P15 (1), a packet starts with both low.
+	lastJoypadWrite byte
+	receiving       bool
+	bitCount        int
+	packet          [sgbPacketSize]byte
+	// Data of the current command, which can span up to 7 packets.
+	command     []byte
+	packetsLeft int
+
+	// Multiplayer: number of joypads (1, 2 or 4) and the one currently selected.
+	numPlayers    int
+	currentPlayer int
+
+	palettes    [4][4]uint16
+	sysPalettes [sgbNumSysPalette][4]uint16
+	// Palette (0-3) of each 8x8 area of the screen.
+	attrs     [sgbAttrRows][sgbAttrCols]byte
+	attrFiles [sgbNumAttrFiles][sgbAttrRows][sgbAttrCols]byte
+	mask      byte
+
+	// Shades of the last frame, used for VRAM transfers: the SGB reads the data from the screen.
+	screen          [DisplayHeight][DisplayWidth]byte
+	pendingTransfer byte
+	chrTrnHigh      bool
+
+	borderTiles    [sgbBorderTiles][32]byte
+	borderMap      [sgbBorderMapRows * sgbBorderMapCols]uint16
+	borderPalettes [4][16]uint16
+	border         [SgbBorderWidth * SgbBorderHeight]uint16
+}
+
+// IsSgbRom returns whether the cartridge supports the Super Game Boy features, according to its header.
+func IsSgbRom(rom []byte) bool {
+	return len(rom) > addrOldLicensee && rom[addrSgbFlag] == 0x03 && rom[addrOldLicensee] == 0x33
+}
+
+// MakeSgb creates a new Sgb that draws on the given display. borderSetter can be nil.
+func MakeSgb(display PixelSetter, borderSetter BorderSetter) *Sgb {
+	s := &Sgb{display: display, borderSetter: borderSetter, numPlayers: 1}
+	for i := range s.palettes {
+		s.palettes[i] = sgbDefaultPalette
+	}
+	return s
+}
+
+func (s *Sgb) SetPixel(r int, c int, color byte, _ PixelSource) {
+	s.screen[r][c] = color
+
+	switch s.mask {
+	case sgbMaskCancel:
+		s.display.SetColorPixel(r, c, s.palettes[s.attrs[r/8][c/8]][color])
+	case sgbMaskBlack:
+		s.display.SetColorPixel(r, c, 0)
+	case sgbMaskColor0:
+		s.display.SetColorPixel(r, c, s.palettes[0][0])
+	}
+
+	if r == DisplayHeight-1 && c == DisplayWidth-1 && s.pendingTransfer != 0 {
+		// A frame has been drawn, the data for the transfer is now on the screen.
+		s.transfer(s.pendingTransfer)
+		s.pendingTransfer = 0
+	}
+}
+
+func (s *Sgb) SetColorPixel(r int, c int, color uint16) {
+	// The SGB never runs CGB games.
+	s.display.SetColorPixel(r, c, color)
+}
+
+// OnJoypadWrite is called when the game writes to the joypad register, to receive packets.
+func (s *Sgb) OnJoypadWrite(v byte) {
+	p14, p15 := isBitSet(v, 4), isBitSet(v, 5)
+	lastP15 := isBitSet(s.lastJoypadWrite, 5)
+	lastHigh := s.lastJoypadWrite&0x30 == 0x30
+	s.lastJoypadWrite = v
+
+	switch {
+	case !p14 && !p15:
+		// Reset pulse, starts a new packet.
+		s.receiving = true
+		s.bitCount = 0
+		s.packet = [sgbPacketSize]byte{}
+	case s.receiving && lastHigh && p14 != p15:
+		s.receiveBit(p14)
+	case !s.receiving && s.numPlayers > 1 && p15 && !lastP15:
+		s.currentPlayer = (s.currentPlayer + 1) % s.numPlayers
+	}
+}
+
+// JoypadId returns the id of the selected joypad, which is read when neither buttons nor d-pad are selected.
+// Returns false if multiplayer is not enabled.
+func (s *Sgb) JoypadId() (byte, bool) {
+	if s.numPlayers == 1 {
+		return 0, false
+	}
+	return 0xf - byte(s.currentPlayer), true
+}
+
+// IsPlayer1Selected returns false if another joypad is selected in multiplayer mode. Other joypads have no keys
+// pressed.
+func (s *Sgb) IsPlayer1Selected() bool {
+	return s.currentPlayer == 0
+}
+
+// receiveBit receives a bit of a packet. P14 low (p14 false) is a 0, P15 low is a 1.
+func (s *Sgb) receiveBit(p14 bool) {
+	if s.bitCount == sgbPacketSize*8 {
+		// Stop bit, the packet is complete.
+		s.receiving = false
+		s.onPacket()
+		return
+	}
+	if p14 {
+		s.packet[s.bitCount/8] |= 1 << (s.bitCount % 8)
+	}
+	s.bitCount++
+}
+
+func (s *Sgb) onPacket() {
+	if s.packetsLeft == 0 {
+		// First packet of a command: the lowest 3 bits are the number of packets.
+		s.packetsLeft = int(s.packet[0] & 0x7)
+		if s.packetsLeft == 0 {
+			return
+		}
+		s.command = s.command[:0]
+	}
+	s.command = append(s.command, s.packet[:]...)
+	s.packetsLeft--
+	if s.packetsLeft == 0 {
+		s.execute(s.command)
+	}
+}
+
+func (s *Sgb) execute(cmd []byte) {
+	switch cmd[0] >> 3 {
+	case sgbPal01:
+		s.setPalettes(cmd, 0, 1)
+	case sgbPal23:
+		s.setPalettes(cmd, 2, 3)
+	case sgbPal03:
+		s.setPalettes(cmd, 0, 3)
+	case sgbPal12:
+		s.setPalettes(cmd, 1, 2)
+	case sgbAttrBlk:
+		s.attrBlock(cmd)
+	case sgbAttrLin:
+		s.attrLine(cmd)
+	case sgbAttrDiv:
+		s.attrDivide(cmd)
+	case sgbAttrChr:
+		s.attrChr(cmd)
+	case sgbPalSet:
+		for i := range s.palettes {
+			index := int(merge(cmd[2+i*2], cmd[1+i*2])) % sgbNumSysPalette
+			s.palettes[i] = s.sysPalettes[index]
+		}
+		s.setColor0(s.palettes[0][0])
+		s.applyAttrFile(cmd[9])
+	case sgbMltReq:
+		s.numPlayers = []int{1, 2, 1, 4}[cmd[1]&0x3]
+		s.currentPlayer = 0
+	case sgbPalTrn, sgbPctTrn, sgbAttrTrn:
+		s.pendingTransfer = cmd[0] >> 3
+	case sgbChrTrn:
+		s.pendingTransfer = sgbChrTrn
+		s.chrTrnHigh = isBitSet(cmd[1], 0)
+	case sgbAttrSet:
+		s.applyAttrFile(cmd[1] | 0x80)
+	case sgbMaskEn:
+		s.mask = cmd[1] & 0x3
+	}
+}
+
+// setPalettes sets the colors of two palettes from a PALxx command. Color 0 is shared by all palettes.
+func (s *Sgb) setPalettes(cmd []byte, first int, second int) {
+	s.setColor0(merge(cmd[2], cmd[1]))
+	for i := 1; i < 4; i++ {
+		s.palettes[first][i] = merge(cmd[2+i*2], cmd[1+i*2])
+		s.palettes[second][i] = merge(cmd[8+i*2], cmd[7+i*2])
+	}
+}
+
+func (s *Sgb) setColor0(color uint16) {
+	for i := range s.palettes {
+		s.palettes[i][0] = color
+	}
+}
+
+// applyAttrFile applies one of the attribute files received with ATTR_TRN, if bit 7 is set. If bit 6 is set, the mask
+// is cancelled.
+func (s *Sgb) applyAttrFile(v byte) {
+	if isBitSet(v, 7) {
+		s.attrs = s.attrFiles[int(v&0x3f)%sgbNumAttrFiles]
+	}
+	if isBitSet(v, 6) {
+		s.mask = sgbMaskCancel
+	}
+}
+
+// attrBlock handles ATTR_BLK: each data set assigns palettes to the inside, border and outside of a rectangle.
+func (s *Sgb) attrBlock(cmd []byte) {
+	numSets := int(cmd[1] & 0x1f)
+	for i := 0; i < numSets && 2+i*6+6 <= len(cmd); i++ {
+		set := cmd[2+i*6:]
+		control := set[0] & 0x7
+		inPal, borderPal, outPal := set[1]&0x3, (set[1]>>2)&0x3, (set[1]>>4)&0x3
+		x1, y1, x2, y2 := int(set[2]&0x1f), int(set[3]&0x1f), int(set[4]&0x1f), int(set[5]&0x1f)
+
+		// When only the inside or the outside is changed, the border is changed as well.
+		if control == 0x1 {
+			control, borderPal = 0x3, inPal
+		} else if control == 0x4 {
+			control, borderPal = 0x6, outPal
+		}
+
+		for y := 0; y < sgbAttrRows; y++ {
+			for x := 0; x < sgbAttrCols; x++ {
+				inside := x > x1 && x < x2 && y > y1 && y < y2
+				outside := x < x1 || x > x2 || y < y1 || y > y2
+				switch {
+				case inside && isBitSet(control, 0):
+					s.attrs[y][x] = inPal
+				case outside && isBitSet(control, 2):
+					s.attrs[y][x] = outPal
+				case !inside && !outside && isBitSet(control, 1):
+					s.attrs[y][x] = borderPal
+				}
+			}
+		}
+	}
+}
+
+// attrLine handles ATTR_LIN: each data set assigns a palette to a whole row or column.
+func (s *Sgb) attrLine(cmd []byte) {
+	numSets := int(cmd[1])
+	for i := 0; i < numSets && 2+i < len(cmd); i++ {
+		v := cmd[2+i]
+		line, pal := int(v&0x1f), (v>>5)&0x3
+		if isBitSet(v, 7) {
+			for x := 0; line < sgbAttrRows && x < sgbAttrCols; x++ {
+				s.attrs[line][x] = pal
+			}
+		} else {
+			for y := 0; line < sgbAttrCols && y < sgbAttrRows; y++ {
+				s.attrs[y][line] = pal
+			}
+		}
+	}
+}
+
+// attrDivide handles ATTR_DIV: splits the screen in two by a row or column, with a palette for each side and for the
+// dividing line.
+func (s *Sgb) attrDivide(cmd []byte) {
+	belowPal, abovePal, linePal := cmd[1]&0x3, (cmd[1]>>2)&0x3, (cmd[1]>>4)&0x3
+	horizontal := isBitSet(cmd[1], 6)
+	line := int(cmd[2] & 0x1f)
+	for y := 0; y < sgbAttrRows; y++ {
+		for x := 0; x < sgbAttrCols; x++ {
+			pos := x
+			if horizontal {
+				pos = y
+			}
+			switch {
+			case pos < line:
+				s.attrs[y][x] = abovePal
+			case pos == line:
+				s.attrs[y][x] = linePal
+			default:
+				s.attrs[y][x] = belowPal
+			}
+		}
+	}
+}
+
+// attrChr handles ATTR_CHR: assigns palettes to consecutive 8x8 areas, starting from a given position.
+func (s *Sgb) attrChr(cmd []byte) {
+	x, y := int(cmd[1]%sgbAttrCols), int(cmd[2]%sgbAttrRows)
+	numSets := int(merge(cmd[4], cmd[3]))
+	vertical := cmd[5] == 1
+	for i := 0; i < numSets && 6+i/4 < len(cmd); i++ {
+		s.attrs[y][x] = (cmd[6+i/4] >> (6 - 2*(i%4))) & 0x3
+		if vertical {
+			y++
+			if y == sgbAttrRows {
+				y, x = 0, (x+1)%sgbAttrCols
+			}
+		} else {
+			x++
+			if x == sgbAttrCols {
+				x, y = 0, (y+1)%sgbAttrRows
+			}
+		}
+	}
+}
+
+// transfer handles the commands that copy 4KB of data from VRAM to the SGB. The game displays the data as tiles on the
+// screen, and the SGB reads it back from the LCD.
+func (s *Sgb) transfer(command byte) {
+	data := s.readScreenData()
+	switch command {
+	case sgbPalTrn:
+		for i := range s.sysPalettes {
+			for c := 0; c < 4; c++ {
+				s.sysPalettes[i][c] = merge(data[i*8+c*2+1], data[i*8+c*2])
+			}
+		}
+	case sgbAttrTrn:
+		for i := range s.attrFiles {
+			for pos := 0; pos < sgbAttrRows*sgbAttrCols; pos++ {
+				v := data[i*sgbAttrFileSize+pos/4]
+				s.attrFiles[i][pos/sgbAttrCols][pos%sgbAttrCols] = (v >> (6 - 2*(pos%4))) & 0x3
+			}
+		}
+	case sgbChrTrn:
+		offset := 0
+		if s.chrTrnHigh {
+			offset = sgbBorderTiles / 2
+		}
+		for i := 0; i < sgbBorderTiles/2; i++ {
+			copy(s.borderTiles[offset+i][:], data[i*32:(i+1)*32])
+		}
+		s.drawBorder()
+	case sgbPctTrn:
+		for i := range s.borderMap {
+			s.borderMap[i] = merge(data[i*2+1], data[i*2])
+		}
+		for p := range s.borderPalettes {
+			for c := range s.borderPalettes[p] {
+				i := 0x800 + p*32 + c*2
+				s.borderPalettes[p][c] = merge(data[i+1], data[i])
+			}
+		}
+		s.drawBorder()
+	}
+}
+
+// readScreenData converts the first 256 tiles on the screen (left to right, top to bottom) back to 2bpp tile data.
+func (s *Sgb) readScreenData() []byte {
+	data := make([]byte, sgbTransferSize)
+	for tile := 0; tile < sgbTransferSize/16; tile++ {
+		tileRow, tileCol := tile/sgbAttrCols, tile%sgbAttrCols
+		for y := 0; y < 8; y++ {
+			var lo, hi byte
+			for x := 0; x < 8; x++ {
+				shade := s.screen[tileRow*8+y][tileCol*8+x]
+				lo |= (shade & 1) << (7 - x)
+				hi |= ((shade >> 1) & 1) << (7 - x)
+			}
+			data[tile*16+y*2] = lo
+			data[tile*16+y*2+1] = hi
+		}
+	}
+	return data
+}
+
+// drawBorder draws the border from the SNES tiles (4 bits per pixel) and the tile map.
+func (s *Sgb) drawBorder() {
+	if s.borderSetter == nil {
+		return
+	}
+	for mapRow := 0; mapRow < sgbBorderMapRows; mapRow++ {
+		for mapCol := 0; mapCol < sgbBorderMapCols; mapCol++ {
+			entry := s.borderMap[mapRow*sgbBorderMapCols+mapCol]
+			tile := &s.borderTiles[entry&0xff]
+			palette := &s.borderPalettes[(entry>>10)&0x3]
+			xFlip, yFlip := entry&0x4000 != 0, entry&0x8000 != 0
+
+			for y := 0; y < 8; y++ {
+				tileY := y
+				if yFlip {
+					tileY = 7 - y
+				}
+				for x := 0; x < 8; x++ {
+					bit := 7 - x
+					if xFlip {
+						bit = x
+					}
+					colorId := tile[tileY*2]>>bit&1 | (tile[tileY*2+1]>>bit&1)<<1 |
+						(tile[16+tileY*2]>>bit&1)<<2 | (tile[16+tileY*2+1]>>bit&1)<<3
+					color := palette[colorId]
+					if colorId == 0 {
+						// Transparent, the background color shows through.
+						color = s.palettes[0][0]
+					}
+					s.border[(mapRow*8+y)*SgbBorderWidth+mapCol*8+x] = color
+				}
+			}
+		}
+	}
+	s.borderSetter.SetBorder(&s.border)
+}
@@ -0,0 +1,117 @@
+package main
+
+import "testing"
+
+// sendSgbCommand sends a command to the SGB through the joypad register, in as many packets as the lowest 3 bits of
+// the first byte say.
+func sendSgbCommand(s *Sgb, cmd ...byte) {
+	numPackets := int(cmd[0] & 0x7)
+	data := make([]byte, numPackets*sgbPacketSize)
+	copy(data, cmd)
+	for p := 0; p < numPackets; p++ {
+		s.OnJoypadWrite(0x00) // Reset pulse
+		s.OnJoypadWrite(0x30)
+		for i := 0; i < sgbPacketSize*8; i++ {
+			if isBitSet(data[p*sgbPacketSize+i/8], i%8) {
+				s.OnJoypadWrite(0x10) // P15 low: 1
+			} else {
+				s.OnJoypadWrite(0x20) // P14 low: 0
+			}
+			s.OnJoypadWrite(0x30)
+		}
+		// Stop bit
+		s.OnJoypadWrite(0x20)
+		s.OnJoypadWrite(0x30)
+	}
+}
+
+func TestSgbPal01(t *testing.T) {
+	s := MakeSgb(headlessDisplay{}, nil)
+	sendSgbCommand(s, sgbPal01<<3|1,
+		0x34, 0x12, // Color 0, shared by all palettes
+		0x01, 0x00, 0x02, 0x00, 0x03, 0x00, // Palette 0, colors 1-3
+		0x11, 0x00, 0x12, 0x00, 0x13, 0x00) // Palette 1, colors 1-3
+
+	want := [4][4]uint16{
+		{0x1234, 0x01, 0x02, 0x03},
+		{0x1234, 0x11, 0x12, 0x13},
+		{0x1234, sgbDefaultPalette[1], sgbDefaultPalette[2], sgbDefaultPalette[3]},
+		{0x1234, sgbDefaultPalette[1], sgbDefaultPalette[2], sgbDefaultPalette[3]},
+	}
+	if s.palettes != want {
+		t.Errorf("Palettes are %04x, want %04x", s.palettes, want)
+	}
+}
+
+func TestSgbAttrBlk(t *testing.T) {
+	tests := []struct {
+		control                     byte
+		wantIn, wantBorder, wantOut byte
+	}{
+		// When only the inside or the outside is changed, the border takes the same palette.
+		{0x1, 1, 1, 0},
+		{0x2, 0, 2, 0},
+		{0x3, 1, 2, 0},
+		{0x4, 0, 3, 3},
+		{0x5, 1, 0, 3},
+		{0x6, 0, 2, 3},
+		{0x7, 1, 2, 3},
+	}
+	for _, tt := range tests {
+		s := MakeSgb(headlessDisplay{}, nil)
+		// A rectangle from (2, 3) to (6, 8), inside palette 1, border 2, outside 3.
+		sendSgbCommand(s, sgbAttrBlk<<3|1, 1, tt.control, 3<<4|2<<2|1, 2, 3, 6, 8)
+
+		cells := []struct {
+			name string
+			x, y int
+			want byte
+		}{
+			{"inside", 4, 5, tt.wantIn},
+			{"left border", 2, 5, tt.wantBorder},
+			{"bottom border", 4, 8, tt.wantBorder},
+			{"outside", 10, 10, tt.wantOut},
+			{"outside above", 4, 2, tt.wantOut},
+		}
+		for _, cell := range cells {
+			if got := s.attrs[cell.y][cell.x]; got != cell.want {
+				t.Errorf("Control 0x%x: the %s (%d, %d) has palette %d, want %d", tt.control, cell.name, cell.x,
+					cell.y, got, cell.want)
+			}
+		}
+	}
+}
+
+func TestSgbAttrChr(t *testing.T) {
+	type cell struct{ x, y int }
+	tests := []struct {
+		name     string
+		x, y     byte
+		vertical bool
+		want     map[cell]byte
+	}{
+		{"left to right, wraps to the next row", 18, 2, false,
+			map[cell]byte{{18, 2}: 1, {19, 2}: 2, {0, 3}: 3, {1, 3}: 1, {2, 3}: 2}},
+		{"top to bottom, wraps to the next column", 5, 15, true,
+			map[cell]byte{{5, 15}: 1, {5, 16}: 2, {5, 17}: 3, {6, 0}: 1, {6, 1}: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := MakeSgb(headlessDisplay{}, nil)
+			direction := byte(0)
+			if tt.vertical {
+				direction = 1
+			}
+			// 5 palettes, 2 bits each from the highest: 1, 2, 3, 1, 2.
+			sendSgbCommand(s, sgbAttrChr<<3|1, tt.x, tt.y, 5, 0, direction, 0x6d, 0x80)
+
+			for y := 0; y < sgbAttrRows; y++ {
+				for x := 0; x < sgbAttrCols; x++ {
+					if got, want := s.attrs[y][x], tt.want[cell{x, y}]; got != want {
+						t.Errorf("(%d, %d) has palette %d, want %d", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+const addrKey1 = 0xff4d
+
+// SpeedSwitch handles the KEY1 register, used on CGB to switch between normal and double speed. The switch is armed by
+// writing KEY1 and happens when the CPU executes STOP.
+type SpeedSwitch struct {
+	cgb         bool
+	armed       bool
+	doubleSpeed bool
+}
+
+func (s *SpeedSwitch) Get(addr uint16) (byte, bool) {
+	if addr != addrKey1 || !s.cgb {
+		return 0, false
+	}
+	v := byte(0x7e)
+	v = setBitValue(v, 7, s.doubleSpeed)
+	v = setBitValue(v, 0, s.armed)
+	return v, true
+}
+
+func (s *SpeedSwitch) Set(addr uint16, v byte) bool {
+	if addr != addrKey1 || !s.cgb {
+		return false
+	}
+	s.armed = isBitSet(v, 0)
+	return true
+}
+
+// OnStop is called when the CPU executes STOP. Returns true if the speed was switched, in which case the CPU continues
+// running instead of stopping.
+func (s *SpeedSwitch) OnStop() bool {
+	if !s.armed {
+		return false
+	}
+	s.armed = false
+	s.doubleSpeed = !s.doubleSpeed
+	return true
+}
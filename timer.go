@@ -1,6 +1,14 @@
 package main
 
-var clockCycles = []uint16{256, 4, 16, 64}
+// The bit of the system counter that clocks TIMA, for each clock select value of TAC: TIMA is incremented when the bit
+// goes from 1 to 0, every 1024, 16, 64 or 256 clocks.
+var clockBits = []int{9, 3, 5, 7}
+
+// The bit of the system counter that clocks the APU frame sequencer (512Hz), one higher in double speed.
+const (
+	frameSequencerBit            = 12
+	frameSequencerBitDoubleSpeed = 13
+)
 
 const (
 	addrDiv  = 0xff04
@@ -9,21 +17,32 @@ const (
 	addrTac  = 0xff07
 )
 
+// Timer is built around the 16-bit system counter, incremented every clock (4 per tick), whose upper byte is DIV.
+// See https://gbdev.io/pandocs/Timer_Obscure_Behaviour.html
+//
+// The timer must tick after the CPU in each emulator tick: the overflow and reload windows last until the end of the
+// next tick, so that the CPU sees them in the tick after the overflow (TIMA is 0, writing it cancels the reload) and
+// in the tick after the reload (writes to TIMA are ignored).
 type Timer struct {
 	apu          *Apu
 	interrupts   *Interrupts
-	ticks        uint16
-	div          byte
+	speed        *SpeedSwitch
+	counter      uint16
 	timerEnabled bool
 	clockSelect  byte
 	tma          byte
 	tima         byte
+	// TIMA overflowed in the last tick: it is 0 until the next tick, which reloads it from TMA and requests the
+	// interrupt.
+	overflow bool
+	// TIMA was reloaded in this tick: writes to TIMA are ignored, writes to TMA also go to TIMA.
+	reloading bool
 }
 
 func (t *Timer) Get(addr uint16) (byte, bool) {
 	switch addr {
 	case addrDiv:
-		return t.div, true
+		return byte(t.counter >> 8), true
 	case addrTima:
 		return t.tima, true
 	case addrTma:
@@ -42,18 +61,29 @@ func (t *Timer) Get(addr uint16) (byte, bool) {
 func (t *Timer) Set(addr uint16, v byte) bool {
 	switch addr {
 	case addrDiv:
-		t.div = 0
-		t.ticks = 0
+		t.ResetDiv()
 		return true
 	case addrTima:
-		t.tima = v
+		if !t.reloading {
+			t.tima = v
+			// Writing TIMA after an overflow cancels the reload and the interrupt.
+			t.overflow = false
+		}
 		return true
 	case addrTma:
 		t.tma = v
+		if t.reloading {
+			t.tima = v
+		}
 		return true
 	case addrTac:
+		// Disabling the timer or selecting another bit can also increment TIMA, if the signal falls.
+		oldSignal := t.timaSignal()
 		t.timerEnabled = isBitSet(v, 2)
 		t.clockSelect = v & 0x3
+		if oldSignal && !t.timaSignal() {
+			t.incrementTima()
+		}
 		return true
 	default:
 		return false
@@ -61,26 +91,53 @@ func (t *Timer) Set(addr uint16, v byte) bool {
 }
 
 func (t *Timer) Tick() {
-	t.ticks++
+	t.reloading = false
+	if t.overflow {
+		t.overflow = false
+		t.tima = t.tma
+		t.reloading = true
+		t.interrupts.RequestInterruptTimer()
+	}
+	t.setCounter(t.counter + 4)
+}
 
-	if t.ticks%64 == 0 {
-		// Increment DIV
-		oldDiv := t.div
-		t.div = oldDiv + 1
-		t.apu.OnTimer(oldDiv, t.div)
+// ResetDiv resets the system counter, on a write to DIV or on STOP. This can make the selected bit fall, which
+// increments TIMA, and clock the frame sequencer.
+func (t *Timer) ResetDiv() {
+	t.setCounter(0)
+}
+
+// setCounter changes the system counter, it increments TIMA on a falling edge of the selected bit, and clocks the APU
+// frame sequencer on a falling edge of its bit.
+func (t *Timer) setCounter(counter uint16) {
+	oldSignal := t.timaSignal()
+	oldFrameSequencerSignal := t.frameSequencerSignal()
+	t.counter = counter
+	if oldSignal && !t.timaSignal() {
+		t.incrementTima()
+	}
+	if oldFrameSequencerSignal && !t.frameSequencerSignal() {
+		t.apu.ClockFrameSequencer()
 	}
+}
+
+// timaSignal returns the input of the falling edge detector that clocks TIMA: the selected bit of the system counter,
+// if the timer is enabled.
+func (t *Timer) timaSignal() bool {
+	return t.timerEnabled && t.counter&(1<<clockBits[t.clockSelect]) != 0
+}
 
-	if t.timerEnabled {
-		selectedCycle := clockCycles[t.clockSelect]
+func (t *Timer) frameSequencerSignal() bool {
+	bit := frameSequencerBit
+	if t.speed.doubleSpeed {
+		bit = frameSequencerBitDoubleSpeed
+	}
+	return t.counter&(1<<bit) != 0
+}
 
-		if t.ticks%selectedCycle == 0 {
-			// Increment TIMA. Trigger interrupt on overflow and reset to TMA
-			if t.tima == 0xff {
-				t.tima = t.tma
-				t.interrupts.RequestInterruptTimer()
-			} else {
-				t.tima++
-			}
-		}
+func (t *Timer) incrementTima() {
+	t.tima++
+	if t.tima == 0 {
+		t.overflow = true
 	}
 }
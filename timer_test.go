@@ -0,0 +1,188 @@
+package main
+
+import "testing"
+
+func TestSpeedSwitchResetsDiv(t *testing.T) {
+	rom := makeTestRom(0x00,
+		0x3e, 0x01, 0xe0, 0x4d, // KEY1 = 1, arm the speed switch
+		0x10, 0x00, // STOP
+		0x18, 0xfe, // JR -2
+	)
+	rom[addrCgbFlag] = 0x80
+	emulator := MakeEmulator(nil, rom, EmulatorOptions{}, headlessDisplay{})
+	emulator.apu.audioEnabled = true
+	// The frame sequencer bit (12) is set, and doesn't fall before STOP.
+	emulator.timer.counter = 0x1800
+
+	for i := 0; i < 100 && !emulator.speed.doubleSpeed; i++ {
+		emulator.Tick()
+	}
+	if !emulator.speed.doubleSpeed {
+		t.Fatal("The speed didn't switch")
+	}
+	if div, _ := emulator.timer.Get(addrDiv); div != 0 {
+		t.Errorf("DIV = %d after the speed switch, want 0", div)
+	}
+	if emulator.apu.frameStep != 1 {
+		t.Errorf("Frame sequencer step = %d, want 1: resetting DIV clocks it", emulator.apu.frameStep)
+	}
+}
+
+// makeTestTimer returns a timer with the given TAC, and the system counter and TIMA set afterward.
+func makeTestTimer(tac byte, counter uint16, tima byte) *Timer {
+	timer := &Timer{apu: &Apu{}, interrupts: &Interrupts{}, speed: &SpeedSwitch{}}
+	timer.Set(addrTac, tac)
+	timer.counter = counter
+	timer.tima = tima
+	return timer
+}
+
+func TestTimerFallingEdgeOnWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		tac      byte
+		counter  uint16
+		addr     uint16
+		value    byte
+		wantTima byte
+	}{
+		{"DIV write, selected bit set", 0x05, 0x0008, addrDiv, 0, 0x11},
+		{"DIV write, selected bit clear", 0x05, 0x0004, addrDiv, 0, 0x10},
+		{"DIV write, timer disabled", 0x01, 0x0008, addrDiv, 0, 0x10},
+		{"DIV write, 1024 clocks", 0x04, 0x0200, addrDiv, 0, 0x11},
+		{"TAC disable, selected bit set", 0x05, 0x0008, addrTac, 0x01, 0x11},
+		{"TAC disable, selected bit clear", 0x05, 0x0004, addrTac, 0x01, 0x10},
+		{"TAC select, old bit set and new bit clear", 0x05, 0x0008, addrTac, 0x06, 0x11},
+		{"TAC select, both bits set", 0x05, 0x0028, addrTac, 0x06, 0x10},
+		{"TAC select, old bit clear and new bit set", 0x05, 0x0020, addrTac, 0x06, 0x10},
+		{"TAC enable, selected bit set", 0x01, 0x0008, addrTac, 0x05, 0x10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timer := makeTestTimer(tt.tac, tt.counter, 0x10)
+			timer.Set(tt.addr, tt.value)
+			if timer.tima != tt.wantTima {
+				t.Errorf("TIMA = 0x%02x, want 0x%02x", timer.tima, tt.wantTima)
+			}
+		})
+	}
+}
+
+// Like Mooneye's tima_write_reloading and tma_write_reloading: writes to TIMA and TMA in the M-cycles around the reload.
+func TestTimerOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		// Ticks between the one where TIMA overflows and the write: 0 is the tick after the overflow (cycle A), where
+		// TIMA is 0, 1 the tick after the reload (cycle B).
+		ticksBeforeWrite int
+		addr             uint16 // 0 if nothing is written
+		value            byte
+		wantTima         byte
+		wantInterrupt    bool
+	}{
+		{"no write", 0, 0, 0, 0x80, true},
+		{"TIMA write in cycle A cancels the reload", 0, addrTima, 0x42, 0x42, false},
+		{"TMA write in cycle A is reloaded", 0, addrTma, 0x42, 0x42, true},
+		{"TIMA write in cycle B is ignored", 1, addrTima, 0x42, 0x80, true},
+		{"TMA write in cycle B also goes to TIMA", 1, addrTma, 0x42, 0x42, true},
+		{"TIMA write after cycle B", 2, addrTima, 0x42, 0x42, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// TIMA is incremented every 1024 clocks, the next tick overflows it.
+			timer := makeTestTimer(0x04, 0x03fc, 0xff)
+			timer.Set(addrTma, 0x80)
+			timer.Tick()
+			if timer.tima != 0 || timer.interrupts.interruptFlag != 0 {
+				t.Fatalf("After the overflow TIMA = 0x%02x and IF = 0x%02x, want 0 and 0", timer.tima,
+					timer.interrupts.interruptFlag)
+			}
+
+			for i := 0; i < tt.ticksBeforeWrite; i++ {
+				timer.Tick()
+			}
+			if tt.addr != 0 {
+				timer.Set(tt.addr, tt.value)
+			}
+			timer.Tick()
+			timer.Tick()
+			if timer.tima != tt.wantTima {
+				t.Errorf("TIMA = 0x%02x, want 0x%02x", timer.tima, tt.wantTima)
+			}
+			if gotInterrupt := isBitSet(timer.interrupts.interruptFlag, 2); gotInterrupt != tt.wantInterrupt {
+				t.Errorf("Timer interrupt requested: %v, want %v", gotInterrupt, tt.wantInterrupt)
+			}
+		})
+	}
+}
+
+// Like Mooneye's div_write: after a write, DIV is incremented 64 M-cycles later, whatever the counter was.
+func TestTimerDivWrite(t *testing.T) {
+	for _, counter := range []uint16{0x0000, 0x00fc, 0x1234, 0xfffc} {
+		timer := makeTestTimer(0x00, counter, 0)
+		timer.Set(addrDiv, 0x12)
+		for i := 1; i <= 64; i++ {
+			timer.Tick()
+			want := byte(0)
+			if i == 64 {
+				want = 1
+			}
+			if div, _ := timer.Get(addrDiv); div != want {
+				t.Fatalf("Counter 0x%04x: DIV is %d %d M-cycles after the write, want %d", counter, div, i, want)
+			}
+		}
+	}
+}
+
+// Like Mooneye's rapid_toggle: disabling the timer while the selected bit is set increments TIMA, enabling it doesn't.
+func TestTimerRapidToggle(t *testing.T) {
+	tests := []struct {
+		name     string
+		counter  uint16
+		wantTima byte
+	}{
+		{"selected bit set", 0x0008, 0x14},
+		{"selected bit clear", 0x0004, 0x10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timer := makeTestTimer(0x05, tt.counter, 0x10)
+			for i := 0; i < 4; i++ {
+				timer.Set(addrTac, 0x01)
+				timer.Set(addrTac, 0x05)
+			}
+			if timer.tima != tt.wantTima {
+				t.Errorf("TIMA = 0x%02x, want 0x%02x", timer.tima, tt.wantTima)
+			}
+		})
+	}
+}
+
+// Like Mooneye's tima_reload: TIMA reads 0 for one M-cycle after the overflow, then TMA, and the interrupt is
+// requested with the reload.
+func TestTimerReloadCycles(t *testing.T) {
+	// TIMA is incremented every 4 M-cycles, the 4th tick overflows it.
+	timer := makeTestTimer(0x05, 0x0000, 0xff)
+	timer.Set(addrTma, 0x23)
+	want := []struct {
+		tima      byte
+		interrupt bool
+	}{
+		{0xff, false},
+		{0xff, false},
+		{0xff, false},
+		{0x00, false}, // Overflow
+		{0x23, true},  // Reload
+		{0x23, true},
+		{0x23, true},
+		{0x24, true},
+	}
+	for i, w := range want {
+		timer.Tick()
+		if gotInterrupt := isBitSet(timer.interrupts.interruptFlag, 2); timer.tima != w.tima ||
+			gotInterrupt != w.interrupt {
+			t.Errorf("M-cycle %d: TIMA = 0x%02x and interrupt %v, want 0x%02x and %v", i+1, timer.tima,
+				gotInterrupt, w.tima, w.interrupt)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	vgmHeaderSize = 0x100
+	vgmVersion    = 0x161
+	vgmSampleRate = 44100
+	// The APU ticks at which the registers are written.
+	vgmApuClockRate = clockFreq * 2
+
+	vgmCmdGbWrite   = 0xb3 // Followed by the register (offset from NR10) and the value.
+	vgmCmdWait      = 0x61 // Followed by the number of samples, 16 bits.
+	vgmCmdWait60th  = 0x62 // 735 samples.
+	vgmCmdWait50th  = 0x63 // 882 samples.
+	vgmCmdShortWait = 0x70 // 0x70-0x7f, 1 to 16 samples.
+	vgmCmdEnd       = 0x66
+)
+
+// VgmTags describe the music of a VGM file, they are saved as GD3 tags.
+type VgmTags struct {
+	track  string
+	game   string
+	author string
+	date   string
+}
+
+// RomVgmTags returns the tags for a game, from the ROM header.
+func RomVgmTags(rom []byte) VgmTags {
+	return VgmTags{game: RomTitle(rom)}
+}
+
+// VgmTags returns the tags for the music of a GBS file.
+func (g *GbsFile) VgmTags() VgmTags {
+	return VgmTags{game: g.title, author: g.author, date: g.copyright}
+}
+
+// VgmRecorder records the writes to the APU registers to a VGM file, which music players can replay. The file starts
+// at the first write and ends at the last one. See https://vgmrips.net/wiki/VGM_Specification.
+type VgmRecorder struct {
+	file   *os.File
+	writer *bufio.Writer
+	tags   VgmTags
+	// The APU tick of the first write, the number of samples and the size of the commands so far.
+	started    bool
+	startTick  int
+	numSamples int
+	dataSize   int
+}
+
+// StartVgmRecording creates the VGM file, the header and the tags are written when the recorder is closed.
+func StartVgmRecording(path string, tags VgmTags) (*VgmRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &VgmRecorder{file: file, writer: bufio.NewWriter(file), tags: tags}
+	// Leave room for the header, which contains the size of the data.
+	if _, err := r.writer.Write(make([]byte, vgmHeaderSize)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddWrite adds a write to an APU register, at the given APU tick.
+func (r *VgmRecorder) AddWrite(tick int, addr uint16, value byte) error {
+	if !r.started {
+		r.started = true
+		r.startTick = tick
+	}
+	samples := int(int64(tick-r.startTick) * vgmSampleRate / vgmApuClockRate)
+	if err := r.wait(samples - r.numSamples); err != nil {
+		return err
+	}
+	return r.writeCommand(vgmCmdGbWrite, byte(addr-addrNr10), value)
+}
+
+// wait adds commands to wait for the given number of samples, with the shortest ones.
+func (r *VgmRecorder) wait(samples int) error {
+	for samples > 0 {
+		var err error
+		n := min(samples, 0xffff)
+		switch {
+		case n <= 16:
+			err = r.writeCommand(vgmCmdShortWait + byte(n-1))
+		case n == 735:
+			err = r.writeCommand(vgmCmdWait60th)
+		case n == 882:
+			err = r.writeCommand(vgmCmdWait50th)
+		default:
+			err = r.writeCommand(vgmCmdWait, byte(n), byte(n>>8))
+		}
+		if err != nil {
+			return err
+		}
+		samples -= n
+		r.numSamples += n
+	}
+	return nil
+}
+
+func (r *VgmRecorder) writeCommand(command ...byte) error {
+	_, err := r.writer.Write(command)
+	r.dataSize += len(command)
+	return err
+}
+
+// Close ends the data, writes the tags and the header, and closes the file.
+func (r *VgmRecorder) Close() error {
+	err := r.writeCommand(vgmCmdEnd)
+	gd3 := r.gd3()
+	if err == nil {
+		_, err = r.writer.Write(gd3)
+	}
+	if err == nil {
+		err = r.writer.Flush()
+	}
+	if err == nil {
+		_, err = r.file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = r.writeHeader(len(gd3))
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (r *VgmRecorder) writeHeader(gd3Size int) error {
+	gd3Offset := vgmHeaderSize + r.dataSize
+	header := make([]byte, vgmHeaderSize)
+	copy(header, "Vgm ")
+	// Offsets are relative to the field.
+	binary.LittleEndian.PutUint32(header[0x04:], uint32(gd3Offset+gd3Size-0x04))
+	binary.LittleEndian.PutUint32(header[0x08:], vgmVersion)
+	binary.LittleEndian.PutUint32(header[0x14:], uint32(gd3Offset-0x14))
+	binary.LittleEndian.PutUint32(header[0x18:], uint32(r.numSamples))
+	binary.LittleEndian.PutUint32(header[0x34:], vgmHeaderSize-0x34)
+	binary.LittleEndian.PutUint32(header[0x80:], clockFreq*4) // Game Boy DMG clock
+	_, err := r.file.Write(header)
+	return err
+}
+
+// gd3 returns the tags: strings in UTF-16, each in English and Japanese (left empty).
+func (r *VgmRecorder) gd3() []byte {
+	var text []byte
+	for _, s := range []string{
+		r.tags.track, "",
+		r.tags.game, "",
+		"Nintendo Game Boy", "",
+		r.tags.author, "",
+		r.tags.date,
+		"", // Ripped by
+		"", // Notes
+	} {
+		for _, c := range utf16.Encode([]rune(s)) {
+			text = binary.LittleEndian.AppendUint16(text, c)
+		}
+		text = binary.LittleEndian.AppendUint16(text, 0)
+	}
+
+	gd3 := []byte("Gd3 ")
+	gd3 = binary.LittleEndian.AppendUint32(gd3, 0x100) // Version
+	gd3 = binary.LittleEndian.AppendUint32(gd3, uint32(len(text)))
+	return append(gd3, text...)
+}
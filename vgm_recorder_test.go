@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestVgmRecorder(t *testing.T) {
+	writes := []struct {
+		// Samples since the previous write.
+		wait     int
+		addr     uint16
+		value    byte
+		wantWait []byte
+	}{
+		{0, addrNr52, 0x80, nil},
+		{1, addrNr50, 0x77, []byte{0x70}},
+		{16, addrNr51, 0xff, []byte{0x7f}},
+		{17, addrNr12, 0xf0, []byte{0x61, 0x11, 0x00}},
+		{735, addrNr13, 0x42, []byte{0x62}},
+		{882, addrNr14, 0x87, []byte{0x63}},
+		{1000, addrWavePattern, 0x12, []byte{0x61, 0xe8, 0x03}},
+		{0xffff + 4, addrNr52, 0x00, []byte{0x61, 0xff, 0xff, 0x73}},
+	}
+
+	path := filepath.Join(t.TempDir(), "out.vgm")
+	tags := VgmTags{track: "Title", game: "Pokémon", author: "Author", date: "1998"}
+	recorder, err := StartVgmRecording(path, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first write is at an arbitrary tick, the file starts there.
+	const startTick = 12345
+	var wantData []byte
+	samples := 0
+	for _, w := range writes {
+		samples += w.wait
+		// The first APU tick in the sample.
+		tick := startTick + (samples*vgmApuClockRate+vgmSampleRate-1)/vgmSampleRate
+		if err := recorder.AddWrite(tick, w.addr, w.value); err != nil {
+			t.Fatal(err)
+		}
+		wantData = append(wantData, w.wantWait...)
+		wantData = append(wantData, vgmCmdGbWrite, byte(w.addr-addrNr10), w.value)
+	}
+	wantData = append(wantData, vgmCmdEnd)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := func(offset int) int {
+		return int(binary.LittleEndian.Uint32(data[offset:]))
+	}
+	if !bytes.HasPrefix(data, []byte("Vgm ")) {
+		t.Fatalf("The file starts with %q, want \"Vgm \"", data[:4])
+	}
+	// Offsets are relative to their field.
+	if got := 0x04 + field(0x04); got != len(data) {
+		t.Errorf("EOF offset %d, want %d", got, len(data))
+	}
+	if got := field(0x08); got != 0x161 {
+		t.Errorf("Version 0x%x, want 0x161", got)
+	}
+	gd3Offset := 0x14 + field(0x14)
+	if got := field(0x18); got != samples {
+		t.Errorf("Total samples %d, want %d", got, samples)
+	}
+	dataOffset := 0x34 + field(0x34)
+	if dataOffset != vgmHeaderSize {
+		t.Errorf("Data offset 0x%x, want 0x%x", dataOffset, vgmHeaderSize)
+	}
+	if got := field(0x80); got != 4194304 {
+		t.Errorf("DMG clock %d, want 4194304", got)
+	}
+	if got := data[dataOffset:gd3Offset]; !bytes.Equal(got, wantData) {
+		t.Errorf("Data is % x, want % x", got, wantData)
+	}
+
+	gd3 := data[gd3Offset:]
+	if !bytes.HasPrefix(gd3, []byte("Gd3 ")) || binary.LittleEndian.Uint32(gd3[4:]) != 0x100 {
+		t.Fatalf("GD3 header is % x, want \"Gd3 \" and version 0x100", gd3[:8])
+	}
+	if got := int(binary.LittleEndian.Uint32(gd3[8:])); got != len(gd3)-12 {
+		t.Errorf("GD3 length %d, want %d", got, len(gd3)-12)
+	}
+	var text []uint16
+	for i := 12; i+1 < len(gd3); i += 2 {
+		text = append(text, binary.LittleEndian.Uint16(gd3[i:]))
+	}
+	var strs []string
+	for len(text) > 0 {
+		end := 0
+		for text[end] != 0 {
+			end++
+		}
+		strs = append(strs, string(utf16.Decode(text[:end])))
+		text = text[end+1:]
+	}
+	wantStrs := []string{"Title", "", "Pokémon", "", "Nintendo Game Boy", "", "Author", "", "1998", "", ""}
+	if !reflect.DeepEqual(strs, wantStrs) {
+		t.Errorf("GD3 strings are %q, want %q", strs, wantStrs)
+	}
+}
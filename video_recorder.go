@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Frame rate of the Game Boy: a frame is 154 lines of 456 dots, at 4Mhz.
+const (
+	frameRateNum = clockFreq * 4
+	frameRateDen = numScanLines * numDotsPerLine
+)
+
+// VideoRecorder records the emulated frames to a Y4M file and the audio to a WAV file with the same name, which can
+// be combined with other tools (e.g. ffmpeg -i clip.y4m -i clip.wav clip.mp4). Both are uncompressed and, since they
+// are driven by the emulator instead of the wall clock, the video is smooth at ~59.7 fps and in sync with the audio.
+type VideoRecorder struct {
+	videoFile *os.File
+	video     *bufio.Writer
+	audio     *WavWriter
+	// Y, U and V planes of a frame (4:4:4, so that colors are not subsampled).
+	planes [3][numPixels]byte
+}
+
+// StartVideoRecording creates the video file at the given path (which should end with .y4m) and the audio file next
+// to it.
+func StartVideoRecording(path string) (*VideoRecorder, error) {
+	videoFile, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := CreateWavWriter(strings.TrimSuffix(path, ".y4m")+".wav", apuSampleRate, 2)
+	if err != nil {
+		videoFile.Close()
+		return nil, err
+	}
+
+	r := &VideoRecorder{videoFile: videoFile, video: bufio.NewWriter(videoFile), audio: audio}
+	_, err = fmt.Fprintf(r.video, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C444\n", DisplayWidth, DisplayHeight,
+		frameRateNum, frameRateDen)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddFrame adds a frame of RGBA pixels.
+func (r *VideoRecorder) AddFrame(pixels []byte) error {
+	for i := 0; i < numPixels; i++ {
+		red, green, blue := int(pixels[i*bytesPerPixel]), int(pixels[i*bytesPerPixel+1]), int(pixels[i*bytesPerPixel+2])
+		// BT.601 full range conversion, in fixed point.
+		r.planes[0][i] = clampByte((77*red + 150*green + 29*blue + 128) >> 8)
+		r.planes[1][i] = clampByte(((-43*red - 85*green + 128*blue + 128) >> 8) + 128)
+		r.planes[2][i] = clampByte(((128*red - 107*green - 21*blue + 128) >> 8) + 128)
+	}
+
+	if _, err := r.video.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	for _, plane := range r.planes {
+		if _, err := r.video.Write(plane[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSample adds an audio sample.
+func (r *VideoRecorder) AddSample(sample AudioSample) error {
+	return r.audio.WriteSample(sample.left, sample.right)
+}
+
+// Close finishes writing the files.
+func (r *VideoRecorder) Close() error {
+	err := r.video.Flush()
+	if closeErr := r.videoFile.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := r.audio.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func clampByte(v int) byte {
+	return byte(max(0, min(255, v)))
+}
@@ -0,0 +1,118 @@
+package main
+
+const (
+	addrHdma1 = 0xff51
+	addrHdma2 = 0xff52
+	addrHdma3 = 0xff53
+	addrHdma4 = 0xff54
+	addrHdma5 = 0xff55
+
+	vramDmaBlockSize = 16
+	// Copying a block takes 8 M-cycles (in normal speed), during which the CPU is halted.
+	vramDmaBlockCycles = 8
+)
+
+// VramDma is the CGB DMA that copies data to VRAM, in blocks of 16 bytes. It works in two modes:
+// - General purpose DMA: all the blocks are copied at once.
+// - HBlank DMA: a block is copied at the beginning of each HBlank.
+// The CPU is halted while blocks are copied.
+type VramDma struct {
+	mcu    *Mcu
+	ppuMem *PpuMemory
+	speed  *SpeedSwitch
+	cgb    bool
+
+	src, dst     uint16
+	blocksLeft   int
+	hBlankActive bool
+	// Number of CPU cycles the CPU is still halted for.
+	haltCycles int
+}
+
+func (d *VramDma) Get(addr uint16) (byte, bool) {
+	if !d.cgb || addr < addrHdma1 || addr > addrHdma5 {
+		return 0, false
+	}
+	if addr != addrHdma5 {
+		// Source and destination are write-only.
+		return openValue, true
+	}
+
+	// Remaining length, bit 7 is 0 while an HBlank DMA is in progress. Reads 0xff when done.
+	v := byte(d.blocksLeft-1) & 0x7f
+	if !d.hBlankActive {
+		v |= 0x80
+	}
+	return v, true
+}
+
+func (d *VramDma) Set(addr uint16, v byte) bool {
+	if !d.cgb || addr < addrHdma1 || addr > addrHdma5 {
+		return false
+	}
+
+	switch addr {
+	case addrHdma1:
+		d.src = uint16(v)<<8 | d.src&0xff
+	case addrHdma2:
+		d.src = d.src&0xff00 | uint16(v&0xf0) // The lower 4 bits are ignored.
+	case addrHdma3:
+		d.dst = uint16(v&0x1f)<<8 | d.dst&0xff // The destination is always in VRAM.
+	case addrHdma4:
+		d.dst = d.dst&0xff00 | uint16(v&0xf0)
+	case addrHdma5:
+		if d.hBlankActive && !isBitSet(v, 7) {
+			// Writing bit 7 = 0 during an HBlank DMA cancels it.
+			d.hBlankActive = false
+			return true
+		}
+		d.blocksLeft = int(v&0x7f) + 1
+		if isBitSet(v, 7) {
+			d.hBlankActive = true
+			if !d.ppuMem.lcdOn() {
+				// There are no HBlanks with the LCD off, the first block is copied immediately.
+				d.copyBlock()
+			}
+		} else {
+			for d.blocksLeft > 0 {
+				d.copyBlock()
+			}
+		}
+	}
+	return true
+}
+
+// OnHBlank is called by the PPU when entering HBlank.
+func (d *VramDma) OnHBlank() {
+	if d.hBlankActive {
+		d.copyBlock()
+	}
+}
+
+// HaltsCpu returns true if the CPU should not run during the current cycle because a transfer is in progress.
+func (d *VramDma) HaltsCpu() bool {
+	if d.haltCycles == 0 {
+		return false
+	}
+	d.haltCycles--
+	return true
+}
+
+func (d *VramDma) copyBlock() {
+	for i := uint16(0); i < vramDmaBlockSize; i++ {
+		d.mcu.Set(addrRomEnd+(d.dst+i)&0x1fff, d.mcu.Get(d.src+i))
+	}
+	d.src += vramDmaBlockSize
+	d.dst = (d.dst + vramDmaBlockSize) & 0x1fff
+
+	// In double speed the duration is the same, but it's twice the number of CPU cycles.
+	d.haltCycles += vramDmaBlockCycles
+	if d.speed.doubleSpeed {
+		d.haltCycles += vramDmaBlockCycles
+	}
+
+	d.blocksLeft--
+	if d.blocksLeft == 0 {
+		d.hBlankActive = false
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+// makeDmaTestEmulator returns a CGB emulator with a pattern in WRAM at 0xc000, and HDMA1-4 set to copy it to 0x8000.
+func makeDmaTestEmulator() Emulator {
+	rom := makeTestRom(0x00, 0x18, 0xfe) // JR -2
+	rom[addrCgbFlag] = 0x80
+	emulator := MakeEmulator(nil, rom, EmulatorOptions{}, headlessDisplay{})
+	mcu := emulator.mcu
+	for i := uint16(0); i < 0x1000; i++ {
+		mcu.Set(0xc000+i, byte(i%251+1))
+	}
+	mcu.Set(addrHdma1, 0xc0)
+	mcu.Set(addrHdma2, 0x00)
+	mcu.Set(addrHdma3, 0x00)
+	mcu.Set(addrHdma4, 0x00)
+	return emulator
+}
+
+// copiedBytes returns the number of bytes at the start of VRAM that match the pattern in WRAM.
+func copiedBytes(mcu *Mcu) int {
+	n := 0
+	for n < 0x1000 && mcu.Get(0x8000+uint16(n)) == mcu.Get(0xc000+uint16(n)) {
+		n++
+	}
+	return n
+}
+
+func TestGeneralPurposeDma(t *testing.T) {
+	tests := []struct {
+		hdma5          byte
+		doubleSpeed    bool
+		wantHaltCycles int
+	}{
+		{0x00, false, 8},
+		{0x03, false, 32},
+		{0x7f, false, 1024},
+		// A block takes as long in double speed, which is twice the number of CPU cycles.
+		{0x03, true, 64},
+	}
+	for _, tt := range tests {
+		emulator := makeDmaTestEmulator()
+		emulator.speed.doubleSpeed = tt.doubleSpeed
+		emulator.mcu.Set(addrHdma5, tt.hdma5)
+
+		if got, want := copiedBytes(emulator.mcu), (int(tt.hdma5)+1)*vramDmaBlockSize; got != want {
+			t.Errorf("HDMA5=0x%02x: %d bytes copied, want %d", tt.hdma5, got, want)
+		}
+		if got := emulator.mcu.Get(addrHdma5); got != 0xff {
+			t.Errorf("HDMA5=0x%02x: HDMA5 reads 0x%02x after the transfer, want 0xff", tt.hdma5, got)
+		}
+		haltCycles := 0
+		for emulator.vramDma.HaltsCpu() {
+			haltCycles++
+		}
+		if haltCycles != tt.wantHaltCycles {
+			t.Errorf("HDMA5=0x%02x, double speed %v: the CPU is halted for %d cycles, want %d", tt.hdma5,
+				tt.doubleSpeed, haltCycles, tt.wantHaltCycles)
+		}
+	}
+}
+
+func TestHBlankDma(t *testing.T) {
+	tests := []struct {
+		name string
+		// HDMA5 is written with 0 after this line to cancel the transfer, -1 to let it finish.
+		cancelAfterLine int
+		wantHdma5       []byte
+		wantBytes       int
+	}{
+		{"complete", -1, []byte{0x02, 0x01, 0x00, 0xff, 0xff}, 4 * vramDmaBlockSize},
+		// After a cancel, bit 7 is set and the remaining length is still readable.
+		{"cancelled", 1, []byte{0x02, 0x01, 0x81, 0x81, 0x81}, 2 * vramDmaBlockSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emulator := makeDmaTestEmulator()
+			emulator.mcu.Set(addrLcdControl, 0x91)
+			emulator.mcu.Set(addrHdma5, 0x83) // 4 blocks, in HBlank
+			if got := emulator.mcu.Get(addrHdma5); got != 0x03 {
+				t.Errorf("HDMA5 reads 0x%02x before the first HBlank, want 0x03", got)
+			}
+
+			// One block is copied in the HBlank of each line.
+			for line, want := range tt.wantHdma5 {
+				for i := 0; i < numDotsPerLine; i++ {
+					emulator.ppu.Tick()
+				}
+				if got := emulator.mcu.Get(addrHdma5); got != want {
+					t.Errorf("HDMA5 reads 0x%02x after line %d, want 0x%02x", got, line, want)
+				}
+				if line == tt.cancelAfterLine {
+					emulator.mcu.Set(addrHdma5, 0x00)
+				}
+			}
+			if got := copiedBytes(emulator.mcu); got != tt.wantBytes {
+				t.Errorf("%d bytes copied, want %d", got, tt.wantBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+)
+
+// DumpVram saves the tiles, the two tile maps and the sprites to PNG files in the given directory, and returns the
+// paths of the files. The sprites are 8x16 if LCDC enables them, and their transparent pixels are transparent.
+func DumpVram(viewer *VramViewer, palette *DmgPalette, dir string) ([]string, error) {
+	images := []struct {
+		name string
+		img  image.Image
+	}{
+		{"tiles.png", viewer.TilesImage(palette)},
+		{fmt.Sprintf("tilemap_%04x.png", tileMaps[0]), viewer.TileMapImage(0, palette, false)},
+		{fmt.Sprintf("tilemap_%04x.png", tileMaps[1]), viewer.TileMapImage(1, palette, false)},
+		{"sprites.png", viewer.SpritesImage(palette, color.RGBA{})},
+	}
+
+	var paths []string
+	for _, img := range images {
+		path := filepath.Join(dir, img.name)
+		if err := SavePng(img.img, path); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// headlessDisplay discards the pixels.
+type headlessDisplay struct{}
+
+func (d headlessDisplay) SetPixel(int, int, byte, PixelSource) {}
+
+func (d headlessDisplay) SetColorPixel(int, int, uint16) {}
+
+// DumpVramAfter runs the game, as fast as possible and without display, for the given number of frames, then dumps
+// VRAM like DumpVram.
+func DumpVramAfter(bootRom []byte, rom []byte, frames int, palette *DmgPalette, dir string) ([]string, error) {
+	emulator := MakeEmulator(bootRom, rom, EmulatorOptions{fastPpu: true}, headlessDisplay{})
+	for i := 0; i < frames*ticksPerFrame; i++ {
+		emulator.Tick()
+	}
+	return DumpVram(MakeVramViewer(emulator.mcu, emulator.ppuMemory), palette, dir)
+}
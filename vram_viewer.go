@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	numTiles        = 384
+	tilesPerRow     = 16
+	tileMapSize     = 32
+	spritesPerRow   = 8
+	numSprites      = 40
+	viewerCellSpace = 2
+)
+
+var (
+	viewportColor = color.RGBA{R: 0xff, A: 0xff}
+	windowColor   = color.RGBA{G: 0xc0, A: 0xff}
+)
+
+// VramViewer draws the content of VRAM and OAM (tiles, tile maps and sprites) as images, for debugging.
+type VramViewer struct {
+	mcu *Mcu
+	mem *PpuMemory
+}
+
+func MakeVramViewer(mcu *Mcu, mem *PpuMemory) *VramViewer {
+	return &VramViewer{mcu: mcu, mem: mem}
+}
+
+// TilesImage returns all the tiles, 16 per row, with the background palette (the first one on CGB). On CGB, the tiles
+// of the second VRAM bank are on the right.
+func (v *VramViewer) TilesImage(palette *DmgPalette) *image.RGBA {
+	numBanks := 1
+	if v.mem.cgb {
+		numBanks = 2
+	}
+	bankWidth := tilesPerRow * 8
+	img := image.NewRGBA(image.Rect(0, 0, numBanks*bankWidth+(numBanks-1)*viewerCellSpace, numTiles/tilesPerRow*8))
+	for bank := 0; bank < numBanks; bank++ {
+		for tile := 0; tile < numTiles; tile++ {
+			x := bank*(bankWidth+viewerCellSpace) + tile%tilesPerRow*8
+			y := tile / tilesPerRow * 8
+			tileStart := tileBlocks[0] + uint16(tile)*16
+			v.drawTile(img, x, y, bank, tileStart, 0, func(pixel byte) color.RGBA {
+				return v.bgColor(palette, 0, pixel)
+			})
+		}
+	}
+	return img
+}
+
+// TileMapImage returns the tile map at tileMaps[mapIndex], as the background or the window would show it. If highlight
+// is true, the areas shown on the LCD by the background (SCX/SCY) and by the window are outlined, if they use this
+// tile map.
+func (v *VramViewer) TileMapImage(mapIndex int, palette *DmgPalette, highlight bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileMapSize*8, tileMapSize*8))
+	for i := 0; i < tileMapSize*tileMapSize; i++ {
+		mapOffset := tileMaps[mapIndex] + uint16(i) - addrRomEnd
+		tileId := v.mcu.vram[0][mapOffset]
+		var attrs byte
+		if v.mem.cgb {
+			attrs = v.mcu.vram[1][mapOffset]
+		}
+
+		// Same addressing as PpuFetcher.
+		tileBlockStart := tileBlocks[0]
+		if !v.mem.lcdBgWndTiles() && tileId < 128 {
+			tileBlockStart = tileBlocks[2]
+		} else if tileId >= 128 {
+			tileBlockStart = tileBlocks[1]
+		}
+		bank := 0
+		if isBitSet(attrs, tileAttrBank) {
+			bank = 1
+		}
+		tileStart := tileBlockStart + 16*uint16(tileId%128)
+		v.drawTile(img, i%tileMapSize*8, i/tileMapSize*8, bank, tileStart, attrs, func(pixel byte) color.RGBA {
+			return v.bgColor(palette, attrs&0x7, pixel)
+		})
+	}
+
+	if !highlight {
+		return img
+	}
+	if v.mem.lcdBgTileMap() == (mapIndex == 1) {
+		drawRect(img, int(v.mem.lcdScrollX), int(v.mem.lcdScrollY), DisplayWidth, DisplayHeight, viewportColor)
+	}
+	if v.mem.wndEnabled() && v.mem.lcdWndTileMap() == (mapIndex == 1) {
+		// The window is drawn from its top-left corner, the size is the part that is on screen.
+		width := DisplayWidth - max(int(v.mem.windowX)-7, 0)
+		height := DisplayHeight - int(v.mem.windowY)
+		if width > 0 && height > 0 {
+			drawRect(img, 0, 0, width, height, windowColor)
+		}
+	}
+	return img
+}
+
+// SpritesImage returns the 40 sprites in OAM, 8 per row, as they are drawn on the LCD (8x8 or 8x16, flipped,
+// with their palette). Transparent pixels, and the space between sprites, have the given color.
+func (v *VramViewer) SpritesImage(palette *DmgPalette, transparent color.RGBA) *image.RGBA {
+	height := int(v.mem.lcdObjHeight())
+	img := image.NewRGBA(image.Rect(0, 0, spritesPerRow*(8+viewerCellSpace)-viewerCellSpace,
+		numSprites/spritesPerRow*(height+viewerCellSpace)-viewerCellSpace))
+	draw.Draw(img, img.Bounds(), image.NewUniform(transparent), image.Point{}, draw.Src)
+	for id := byte(0); id < numSprites; id++ {
+		sprite := LoadSprite(v.mcu, id)
+		x := int(id) % spritesPerRow * (8 + viewerCellSpace)
+		y := int(id) / spritesPerRow * (height + viewerCellSpace)
+		bank := 0
+		if v.mem.cgb {
+			bank = int(sprite.vramBank)
+		}
+
+		tileNum := sprite.tileNum
+		if height == 16 {
+			tileNum &= 0xfe
+		}
+		var attrs byte
+		if sprite.xFlip {
+			attrs |= 1 << tileAttrXFlip
+		}
+		if sprite.yFlip {
+			attrs |= 1 << tileAttrYFlip
+		}
+		for tile := 0; tile < height/8; tile++ {
+			// When flipped, the two tiles of a 8x16 sprite are swapped.
+			tileY := y + tile*8
+			if sprite.yFlip {
+				tileY = y + height - 8 - tile*8
+			}
+			tileStart := tileBlocks[0] + 16*uint16(tileNum+byte(tile))
+			v.drawTile(img, x, tileY, bank, tileStart, attrs, func(pixel byte) color.RGBA {
+				if pixel == 0 {
+					return transparent
+				}
+				return v.objColor(palette, &sprite, pixel)
+			})
+		}
+	}
+	return img
+}
+
+// SpritesInfo returns a line describing each of the 40 sprites in OAM.
+func (v *VramViewer) SpritesInfo() []string {
+	var lines []string
+	for id := byte(0); id < numSprites; id++ {
+		s := LoadSprite(v.mcu, id)
+		flags := ""
+		for _, flag := range []struct {
+			set  bool
+			name string
+		}{{s.xFlip, "X"}, {s.yFlip, "Y"}, {s.bgPriority, "P"}} {
+			if flag.set {
+				flags += flag.name
+			} else {
+				flags += "-"
+			}
+		}
+		palette := "OBP0"
+		if !s.palette0 {
+			palette = "OBP1"
+		}
+		if v.mem.cgb {
+			palette = fmt.Sprintf("PAL%d BANK%d", s.cgbPalette, s.vramBank)
+		}
+		lines = append(lines, fmt.Sprintf("%02d X:%3d Y:%3d T:%02X %s %s", id, s.x, s.y, s.tileNum, flags, palette))
+	}
+	return lines
+}
+
+// drawTile draws an 8x8 tile, starting at the given VRAM address. Only the flip bits of attrs are used.
+func (v *VramViewer) drawTile(img *image.RGBA, x int, y int, bank int, tileStart uint16, attrs byte,
+	colorOf func(pixel byte) color.RGBA) {
+	for row := 0; row < 8; row++ {
+		offset := tileStart + uint16(row)*2 - addrRomEnd
+		tileData0, tileData1 := v.mcu.vram[bank][offset], v.mcu.vram[bank][offset+1]
+		imgRow := row
+		if isBitSet(attrs, tileAttrYFlip) {
+			imgRow = 7 - row
+		}
+		for col := 0; col < 8; col++ {
+			imgCol := col
+			if isBitSet(attrs, tileAttrXFlip) {
+				imgCol = 7 - col
+			}
+			img.SetRGBA(x+imgCol, y+imgRow, colorOf(tileDataPixel(tileData0, tileData1, col)))
+		}
+	}
+}
+
+func (v *VramViewer) bgColor(palette *DmgPalette, cgbPalette byte, pixel byte) color.RGBA {
+	if v.mem.cgb {
+		return rgb555ToRgba(cgbColor(&v.mem.bgPaletteRam, cgbPalette, pixel))
+	}
+	return rgbToRgba(palette.bg[paletteColor(v.mem.bgPalette, pixel)])
+}
+
+func (v *VramViewer) objColor(palette *DmgPalette, sprite *Sprite, pixel byte) color.RGBA {
+	switch {
+	case v.mem.cgb:
+		return rgb555ToRgba(cgbColor(&v.mem.objPaletteRam, sprite.cgbPalette, pixel))
+	case sprite.palette0:
+		return rgbToRgba(palette.obj0[paletteColor(v.mem.objPalette0, pixel)])
+	default:
+		return rgbToRgba(palette.obj1[paletteColor(v.mem.objPalette1, pixel)])
+	}
+}
+
+// drawRect draws the outline of a rectangle, wrapping around the edges of the image like the tile maps do.
+func drawRect(img *image.RGBA, x int, y int, width int, height int, c color.RGBA) {
+	size := img.Bounds().Size()
+	for i := 0; i < width; i++ {
+		img.SetRGBA((x+i)%size.X, y%size.Y, c)
+		img.SetRGBA((x+i)%size.X, (y+height-1)%size.Y, c)
+	}
+	for i := 0; i < height; i++ {
+		img.SetRGBA(x%size.X, (y+i)%size.Y, c)
+		img.SetRGBA((x+width-1)%size.X, (y+i)%size.Y, c)
+	}
+}
+
+func rgbToRgba(rgb [3]byte) color.RGBA {
+	return color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff}
+}
+
+func rgb555ToRgba(c uint16) color.RGBA {
+	return color.RGBA{R: rgb555To888(c), G: rgb555To888(c >> 5), B: rgb555To888(c >> 10), A: 0xff}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	wavHeaderSize    = 44
+	wavBitsPerSample = 16
+)
+
+// WavWriter writes 16 bit PCM audio to a WAV file.
+type WavWriter struct {
+	file        *os.File
+	writer      *bufio.Writer
+	sampleRate  int
+	numChannels int
+	numSamples  int
+}
+
+// CreateWavWriter creates the WAV file, the header is written when the writer is closed.
+func CreateWavWriter(path string, sampleRate int, numChannels int) (*WavWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &WavWriter{file: file, writer: bufio.NewWriter(file), sampleRate: sampleRate, numChannels: numChannels}
+	// Leave room for the header, which contains the size of the data.
+	if _, err := w.writer.Write(make([]byte, wavHeaderSize)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WriteSample adds a sample, with a value between -1 and 1 for each channel (e.g. left and right).
+func (w *WavWriter) WriteSample(values ...float32) error {
+	if len(values) != w.numChannels {
+		return fmt.Errorf("%d values for a WAV file with %d channels", len(values), w.numChannels)
+	}
+	for _, v := range values {
+		if err := binary.Write(w.writer, binary.LittleEndian, toPcm16(v)); err != nil {
+			return err
+		}
+	}
+	w.numSamples++
+	return nil
+}
+
+// Close writes the header and closes the file.
+func (w *WavWriter) Close() error {
+	err := w.writer.Flush()
+	if err == nil {
+		_, err = w.file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = w.writeHeader()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *WavWriter) writeHeader() error {
+	blockAlign := w.numChannels * wavBitsPerSample / 8
+	dataSize := uint32(w.numSamples * blockAlign)
+
+	header := make([]byte, 0, wavHeaderSize)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, wavHeaderSize-8+dataSize)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16) // Size of the fmt chunk
+	header = binary.LittleEndian.AppendUint16(header, 1)  // PCM
+	header = binary.LittleEndian.AppendUint16(header, uint16(w.numChannels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(w.sampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(w.sampleRate*blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, wavBitsPerSample)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, dataSize)
+	_, err := w.file.Write(header)
+	return err
+}
+
+func toPcm16(v float32) int16 {
+	return int16(max(-1, min(1, v)) * 32767)
+}